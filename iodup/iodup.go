@@ -5,13 +5,18 @@ package iodup
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
 // An Iodup object maintining internal buffers and state
 type Out struct {
-	outBuf  []byte
-	bufChan chan []byte
+	outBuf    []byte
+	bufChan   chan []byte
+	err       error         // the source error returned once the data drains, set before bufChan is closed
+	closed    chan struct{} // closed by Close, the output no longer receives data
+	closeOnce sync.Once
+	iod       *Iodup
 }
 
 type Iodup struct {
@@ -23,6 +28,9 @@ type Iodup struct {
 	numOutputs uint
 	sizeBuf    uint
 	src        io.ReadCloser
+	mu         sync.Mutex
+	numOpen    uint          // the number of outputs not yet closed
+	closed     chan struct{} // closed once all outputs closed, stopping the goroutine
 }
 
 // Create a New iodup to wrap an existing provider of an io.ReadCloser interface
@@ -79,6 +87,8 @@ func New(src io.ReadCloser, params ...uint) (iod *Iodup) {
 	iod.numBufs = numBufs
 	iod.sizeBuf = sizeBuf
 	iod.src = src
+	iod.numOpen = numOutputs
+	iod.closed = make(chan struct{})
 
 	// create s.numOutputs outputs
 	iod.Output = make([]*Out, iod.numOutputs)
@@ -92,6 +102,8 @@ func New(src io.ReadCloser, params ...uint) (iod *Iodup) {
 		// we will maintain a maximum of s.numBufs-2 in s.bufChan + one buffer in s.inBuf + one buffer s.outBuf
 		iod.Output[j] = new(Out)
 		iod.Output[j].bufChan = make(chan []byte, iod.numBufs-2)
+		iod.Output[j].closed = make(chan struct{})
+		iod.Output[j].iod = iod
 	}
 	iod.bufs = make([][]byte, iod.numBufs)
 	for i := uint(0); i < iod.numBufs; i++ {
@@ -103,7 +115,7 @@ func New(src io.ReadCloser, params ...uint) (iod *Iodup) {
 	go func() {
 		var n int
 		var err error
-		for err == nil {
+		for err == nil && !iod.isClosed() {
 			n, err = iod.readFromSrc()
 			if n > 0 { // we have data
 				iod.forwardToOut(iod.inBuf[:n])
@@ -118,16 +130,19 @@ func New(src io.ReadCloser, params ...uint) (iod *Iodup) {
 					// "Implementations of Read are discouraged from returning a zero byte count with a nil error"
 					// "Callers should treat a return of 0 and nil as indicating that nothing happened"
 					// But even if nothing happened, we should not just abuse the CPU with an endless loop..
-					time.Sleep(100 * time.Millisecond)
+					select {
+					case <-time.After(100 * time.Millisecond):
+					case <-iod.closed:
+					}
 				}
 			}
 		}
 
-		if err.Error() != "EOF" {
-			fmt.Printf("(iof *iodup) Gorutine err %v\n", err)
-		}
-
 		for j := uint(0); j < iod.numOutputs; j++ {
+			if err != nil && err != io.EOF {
+				// the source failed, the readers receive the error once the data drains
+				iod.Output[j].err = err
+			}
 			iod.Output[j].closeChannel()
 		}
 	}()
@@ -142,24 +157,22 @@ func (iod *Iodup) forwardToOut(buf []byte) {
 		}
 
 		// we never close bufChan from the receiver side, so we should never panic here!
-		// closing the source is not a great idea...
 	}()
 
 	for j := uint(0); j < iod.numOutputs; j++ {
-		iod.Output[j].bufChan <- buf
+		// skip outputs closed by their readers, which no longer receive data
+		select {
+		case iod.Output[j].bufChan <- buf:
+		case <-iod.Output[j].closed:
+		}
 	}
 }
 func (iod *Iodup) readFromSrc() (n int, err error) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			fmt.Printf("(iof *iodup) readFromSrc recovering from panic... %v\n", recovered)
-
-			// We close the internal channel to signal from the src to readers that we are done
-			for j := uint(0); j < iod.numOutputs; j++ {
-				close(iod.Output[j].bufChan)
-			}
 			n = 0
-			err = io.EOF
+			err = fmt.Errorf("iodup source paniced: %v", recovered)
 		}
 	}()
 	n, err = iod.src.Read(iod.inBuf)
@@ -175,6 +188,9 @@ func (out *Out) Read(dest []byte) (n int, err error) {
 		// Block until data arrives
 		if out.outBuf, opened = <-out.bufChan; !opened && out.outBuf == nil {
 			err = io.EOF
+			if out.err != nil {
+				err = out.err
+			}
 			n = 0
 			return
 		}
@@ -187,10 +203,38 @@ func (out *Out) Read(dest []byte) (n int, err error) {
 }
 
 // The io.Close interface of the iodup
-func (out *Out) Close() error {
-	// We ignore close from any of the readers - we close when the source closes
-	return nil
+// The output no longer receives data once closed. Once all outputs are closed,
+// the source is closed and the goroutine reading from it stops. Later calls do nothing.
+func (out *Out) Close() (err error) {
+	out.closeOnce.Do(func() {
+		close(out.closed)
+		err = out.iod.release()
+	})
+	return
 }
+
+// release() closes the source when the last open output is released
+func (iod *Iodup) release() error {
+	iod.mu.Lock()
+	iod.numOpen--
+	last := iod.numOpen == 0
+	iod.mu.Unlock()
+	if !last {
+		return nil
+	}
+	close(iod.closed)
+	return iod.closeSrc()
+}
+
+func (iod *Iodup) isClosed() bool {
+	select {
+	case <-iod.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (out *Out) closeChannel() {
 	defer func() {
 		if recovered := recover(); recovered != nil {
@@ -200,18 +244,16 @@ func (out *Out) closeChannel() {
 	close(out.bufChan)
 }
 
-/*   closing teh src is not a great idea
-func (iof *Iodup) closeSrc() error {
+func (iod *Iodup) closeSrc() (err error) {
 	// There seem to be no standart convension about closing
 	// Some may require it..
 	// Others may always allow it..
 	// Yet there are those who whould panic if closing when already closed..
-	//defer func() {
-	//	if recovered := recover(); recovered != nil {
-	//		fmt.Printf("(iof *iodup) recovering from panic during iof.src.Close() %v\n", recovered)
-	//	}
-	//}()
-	//iof.src.Close()
-	return nil
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fmt.Printf("(iof *iodup) recovering from panic during iof.src.Close() %v\n", recovered)
+			err = nil
+		}
+	}()
+	return iod.src.Close()
 }
-*/
@@ -58,12 +58,12 @@ func TestNewBadReader(t *testing.T) {
 		ur.closePanic = false
 		r1 := New(ur)
 
-		if err := iotest.TestReader(r1.Output[0], []byte("")); err != nil {
-			t.Fatal(err)
+		if got, err := io.ReadAll(r1.Output[0]); len(got) != 0 || err == nil || err.Error() != "Aha!" {
+			t.Fatalf("ReadAll() = %q, %v, want the source error", got, err)
 		}
 
-		if err := iotest.TestReader(r1.Output[1], []byte("")); err != nil {
-			t.Fatal(err)
+		if got, err := io.ReadAll(r1.Output[1]); len(got) != 0 || err == nil || err.Error() != "Aha!" {
+			t.Fatalf("ReadAll() = %q, %v, want the source error", got, err)
 		}
 
 		if err := r1.Output[0].Close(); err != nil {
@@ -76,11 +76,11 @@ func TestNewBadReader(t *testing.T) {
 
 		ur.closePanic = true
 		r2 := New(ur, 2, 7)
-		if err := iotest.TestReader(r2.Output[0], []byte("")); err != nil {
-			t.Fatal(err)
+		if got, err := io.ReadAll(r2.Output[0]); len(got) != 0 || err == nil || err.Error() != "Aha!" {
+			t.Fatalf("ReadAll() = %q, %v, want the source error", got, err)
 		}
-		if err := iotest.TestReader(r2.Output[1], []byte("")); err != nil {
-			t.Fatal(err)
+		if got, err := io.ReadAll(r2.Output[1]); len(got) != 0 || err == nil || err.Error() != "Aha!" {
+			t.Fatalf("ReadAll() = %q, %v, want the source error", got, err)
 		}
 		if err := r2.Output[0].Close(); err != nil {
 			t.Errorf("iodup.Close() error = %v", err)
@@ -211,3 +211,67 @@ func TestNew(t *testing.T) {
 		}
 	})
 }
+
+func TestNewSourceError(t *testing.T) {
+	const msg = "Now is the time for all good gophers."
+	errBroken := errors.New("connection reset")
+	src := io.NopCloser(io.MultiReader(strings.NewReader(msg), iotest.ErrReader(errBroken)))
+	r := New(src, 3, 3, 4)
+	errCh := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func(out *Out) {
+			got, err := io.ReadAll(out)
+			if string(got) != msg {
+				err = fmt.Errorf("read %q", got)
+			}
+			errCh <- err
+		}(r.Output[i])
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errCh; err != errBroken {
+			t.Errorf("ReadAll() error = %v, want the data followed by the source error", err)
+		}
+	}
+}
+
+// closeCounter counts the times the source was closed
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	const msg = "Now is the time for all good gophers."
+	src := &closeCounter{Reader: strings.NewReader(strings.Repeat(msg, 100))}
+	r := New(src, 3, 3, 16)
+
+	// a closed output is skipped, the other outputs receive the data
+	if err := r.Output[0].Close(); err != nil {
+		t.Errorf("Output[0].Close() error = %v", err)
+	}
+	errCh := make(chan error)
+	for _, out := range r.Output[1:] {
+		go func(out *Out) {
+			errCh <- iotest.TestReader(out, []byte(strings.Repeat(msg, 100)))
+		}(out)
+	}
+	for range r.Output[1:] {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Output[0].Close()
+	r.Output[1].Close()
+	if src.closed != 0 {
+		t.Errorf("the source was closed before all outputs closed")
+	}
+	r.Output[2].Close()
+	if src.closed != 1 {
+		t.Errorf("the source was closed %d times", src.closed)
+	}
+}
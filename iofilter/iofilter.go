@@ -6,6 +6,7 @@ package iofilter
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -19,11 +20,24 @@ type Iofilter struct {
 	numBufs    uint
 	sizeBuf    uint
 	src        io.ReadCloser
-	filter     func(buf []byte, state interface{})
+	filter     TransformFilter
 	state      interface{}
+	err        error // the filter or source error returned once the data drains, set before bufChan is closed
 	done       chan bool
+	closed     chan struct{} // closed by Close, stopping the goroutine
+	closeOnce  sync.Once
 }
 
+// A TransformFilter returns the data to be delivered in place of buf
+//
+// out may be buf itself (e.g. after modifying bytes in place), a slice of buf,
+// or a new slice of any length (e.g. after redacting data). An empty out drops buf.
+// buf is reused once out is delivered, hence out may alias buf, but buf must not be retained.
+// A non nil err stops the stream - out is delivered, no more data is read
+// from the source and err is returned to the reader once the data drains.
+// A panic in the filter stops the stream with an error.
+type TransformFilter func(buf []byte, state interface{}) (out []byte, err error)
+
 // Create a New iofilter to wrap an existing provider of an io.ReadCloser interface
 // The new iofilter will expose an io.ReadCloser interface
 // The data will be sent to filter before it is delivered
@@ -33,6 +47,26 @@ type Iofilter struct {
 // A goroutine will be initiatd to wait on the original provider Read interface
 // and deliver the data to the Readwer using an internal channel
 func New(src io.ReadCloser, filter func(buf []byte, state interface{}), state interface{}, params ...uint) (iof *Iofilter) {
+	// the filter only observes the data, which is delivered even when the filter panics
+	observe := func(buf []byte, state interface{}) (out []byte, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				fmt.Printf("(iof *iofilter) filterData recovering from panic... %v\n", recovered)
+				out = buf
+			}
+		}()
+		filter(buf, state)
+		return buf, nil
+	}
+	return NewTransform(src, observe, state, params...)
+}
+
+// Create a NewTransform iofilter to wrap an existing provider of an io.ReadCloser interface
+// The new iofilter will expose an io.ReadCloser interface
+// The data will be sent to filter and the data returned by filter is delivered instead
+// (see TransformFilter), allowing filter to modify, redact or drop data and to stop the stream
+// The optional params are as in New
+func NewTransform(src io.ReadCloser, filter TransformFilter, state interface{}, params ...uint) (iof *Iofilter) {
 	var numBufs, sizeBuf uint
 	switch len(params) {
 	case 0:
@@ -63,6 +97,7 @@ func New(src io.ReadCloser, filter func(buf []byte, state interface{}), state in
 	iof.filter = filter
 	iof.state = state
 	iof.done = make(chan bool)
+	iof.closed = make(chan struct{})
 	iof.src = src
 
 	// create s.numBufs buffers
@@ -79,18 +114,30 @@ func New(src io.ReadCloser, filter func(buf []byte, state interface{}), state in
 	go func() {
 		var n int
 		var err error
-		for err == nil {
+		for err == nil && !iof.isClosed() {
 			//fmt.Printf("(iof *iofilter) Gorutine Reading...\n")
 			n, err = iof.readFromSrc()
 			if n > 0 { // we have data
 				//fmt.Printf("(iof *iofilter) Gorutine read %d bytes\n", n)
-				iof.filterData(iof.inBuf[:n])
+				out, filterErr := iof.filterData(iof.inBuf[:n])
 
-				iof.bufChan <- iof.inBuf[:n]
-				// ok, we now have a maximum of s.numBufs-2 in s.bufChan + one buffer s.outBuf
-				// this means we have one free buffer to give to s.inBuf
-				iof.inBufIndex = (iof.inBufIndex + 1) % iof.numBufs
-				iof.inBuf = iof.bufs[iof.inBufIndex]
+				if len(out) > 0 { // the filter may drop the data
+					select {
+					case iof.bufChan <- out:
+					case <-iof.closed:
+						// the reader closed, no one will ever receive the data
+						continue
+					}
+					// ok, we now have a maximum of s.numBufs-2 in s.bufChan + one buffer s.outBuf
+					// this means we have one free buffer to give to s.inBuf
+					iof.inBufIndex = (iof.inBufIndex + 1) % iof.numBufs
+					iof.inBuf = iof.bufs[iof.inBufIndex]
+				}
+				if filterErr != nil {
+					// stop the stream, the reader receives the error once the data drains
+					iof.err = filterErr
+					break
+				}
 			} else { // no data
 				if err == nil { // no data and no err.... bad, bad writter!!
 					fmt.Printf("(iof *iofilter) Gorutine read no bytes, err is nil!\n")
@@ -98,14 +145,16 @@ func New(src io.ReadCloser, filter func(buf []byte, state interface{}), state in
 					// "Implementations of Read are discouraged from returning a zero byte count with a nil error"
 					// "Callers should treat a return of 0 and nil as indicating that nothing happened"
 					// But even if nothing happened, we should not just abuse the CPU with an endless loop..
-					time.Sleep(100 * time.Millisecond)
+					select {
+					case <-time.After(100 * time.Millisecond):
+					case <-iof.closed:
+					}
 				}
 			}
 		}
-		if err.Error() != "EOF" {
-			fmt.Printf("(iof *iofilter) Gorutine err %v\n", err)
-		} else {
-			//fmt.Printf("(iof *iofilter) reached EOF in reader!\n")
+		if err != nil && err != io.EOF && iof.err == nil && !iof.isClosed() {
+			// the source failed, the reader receives the error once the data drains
+			iof.err = err
 		}
 
 		iof.closeChannel()
@@ -126,6 +175,9 @@ func (iof *Iofilter) Read(dest []byte) (n int, err error) {
 		// Block until data arrives
 		if iof.outBuf, opened = <-iof.bufChan; !opened && iof.outBuf == nil {
 			err = io.EOF
+			if iof.err != nil {
+				err = iof.err
+			}
 			n = 0
 			//fmt.Printf("(iof *iofilter) Read Ended with io.EOF\n")
 			return
@@ -139,16 +191,27 @@ func (iof *Iofilter) Read(dest []byte) (n int, err error) {
 }
 
 // The io.Close interface of the iofilter
-func (iof *Iofilter) Close() error {
-	// We ignore close from any of the readers - we close when the source closes
+// The first Close closes the source and stops the goroutine reading from it,
+// including when it waits for the reader to receive data. Later calls do nothing.
+func (iof *Iofilter) Close() (err error) {
+	iof.closeOnce.Do(func() {
+		//fmt.Printf("(iof *iofilter) Close\n")
+		close(iof.closed)
+		err = iof.closeSrc()
+	})
+	return
+}
 
-	//fmt.Printf("(iof *iofilter) Close\n")
-	//iof.closeSrc()
-	return nil
+func (iof *Iofilter) isClosed() bool {
+	select {
+	case <-iof.closed:
+		return true
+	default:
+		return false
+	}
 }
 
-/*
-func (iof *Iofilter) closeSrc() error {
+func (iof *Iofilter) closeSrc() (err error) {
 	// There seem to be no standart convension about closing
 	// Some may require it..
 	// Others may alwaysb allow it..
@@ -156,12 +219,11 @@ func (iof *Iofilter) closeSrc() error {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			fmt.Printf("(iof *iofilter) recovering from panic during iof.src.Close() %v\n", recovered)
+			err = nil
 		}
 	}()
-	iof.src.Close()
-	return nil
+	return iof.src.Close()
 }
-*/
 
 func (iof *Iofilter) WaitTillDone() {
 	<-iof.done
@@ -171,25 +233,23 @@ func (iof *Iofilter) readFromSrc() (n int, err error) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			fmt.Printf("(iof *iofilter) readFromSrc recovering from panic... %v\n", recovered)
-
-			// We close the internal channel to signal from the src to readers that we are done
-			close(iof.bufChan)
-
 			n = 0
-			err = io.EOF
+			err = fmt.Errorf("iofilter source paniced: %v", recovered)
 		}
 	}()
 	n, err = iof.src.Read(iof.inBuf)
 	return n, err
 }
 
-func (iof *Iofilter) filterData(buf []byte) {
+func (iof *Iofilter) filterData(buf []byte) (out []byte, err error) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			fmt.Printf("(iof *iofilter) filterData recovering from panic... %v\n", recovered)
+			out = nil
+			err = fmt.Errorf("iofilter filter paniced: %v", recovered)
 		}
 	}()
-	iof.filter(buf, iof.state)
+	return iof.filter(buf, iof.state)
 }
 
 func (iof *Iofilter) closeChannel() {
@@ -64,9 +64,9 @@ func TestNewBadReader(t *testing.T) {
 		ur.closePanic = false
 		r1 := New(ur, filterOk, state, 7)
 
-		err1 := iotest.TestReader(r1, []byte(""))
-		if err1 != nil {
-			t.Fatal(err1)
+		// the source error is returned instead of EOF
+		if got, err1 := io.ReadAll(r1); len(got) != 0 || err1 == nil || err1.Error() != "Aha!" {
+			t.Fatalf("ReadAll() = %q, %v", got, err1)
 		}
 
 		if err := r1.Close(); err != nil {
@@ -75,9 +75,9 @@ func TestNewBadReader(t *testing.T) {
 
 		ur.closePanic = true
 		r2 := New(ur, filterOk, state, 7)
-		err2 := iotest.TestReader(r2, []byte(""))
-		if err2 != nil {
-			t.Fatal(err2)
+		// the source error is returned instead of EOF
+		if got, err2 := io.ReadAll(r2); len(got) != 0 || err2 == nil || err2.Error() != "Aha!" {
+			t.Fatalf("ReadAll() = %q, %v", got, err2)
 		}
 		if err := r2.Close(); err != nil {
 			t.Errorf("iofilter.Close() error = %v", err)
@@ -176,3 +176,127 @@ func TestNew(t *testing.T) {
 		}
 	})
 }
+
+func TestNewTransform(t *testing.T) {
+	const msg = "Now is the time for all good gophers."
+	upper := func(buf []byte, state interface{}) ([]byte, error) {
+		return []byte(strings.ToUpper(string(buf))), nil
+	}
+	redact := func(buf []byte, state interface{}) ([]byte, error) {
+		return []byte(strings.ReplaceAll(string(buf), "o", "[o]")), nil
+	}
+	dropSpaces := func(buf []byte, state interface{}) ([]byte, error) {
+		if string(buf) == " " {
+			return nil, nil
+		}
+		return buf, nil
+	}
+	dropAll := func(buf []byte, state interface{}) ([]byte, error) {
+		return buf[:0], nil
+	}
+	tests := []struct {
+		name   string
+		filter TransformFilter
+		params []uint
+		want   string
+	}{
+		{"same length", upper, nil, strings.ToUpper(msg)},
+		{"longer", redact, nil, strings.ReplaceAll(msg, "o", "[o]")},
+		{"longer than a buffer", redact, []uint{3, 1}, strings.ReplaceAll(msg, "o", "[o]")},
+		{"drop chunks", dropSpaces, []uint{3, 1}, strings.ReplaceAll(msg, " ", "")},
+		{"drop all", dropAll, []uint{4, 2}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTransform(io.NopCloser(strings.NewReader(msg)), tt.filter, nil, tt.params...)
+			if err := iotest.TestReader(r, []byte(tt.want)); err != nil {
+				t.Fatal(err)
+			}
+			r.WaitTillDone()
+		})
+	}
+}
+
+func TestNewTransformError(t *testing.T) {
+	const msg = "Now is the time for all good gophers."
+	errStop := errors.New("stop")
+	chunks := 0
+	stopAtT := func(buf []byte, state interface{}) ([]byte, error) {
+		chunks++
+		if buf[0] == 't' {
+			return []byte("T"), errStop
+		}
+		return buf, nil
+	}
+	r := NewTransform(io.NopCloser(strings.NewReader(msg)), stopAtT, nil, 3, 1)
+	got, err := io.ReadAll(r)
+	if err != errStop {
+		t.Errorf("ReadAll returned error %v, want %v", err, errStop)
+	}
+	if string(got) != "Now is T" {
+		t.Errorf("ReadAll returned %q before the error", got)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != errStop {
+		t.Errorf("Read after the error returned %v", err)
+	}
+	r.WaitTillDone()
+	if chunks != len("Now is t") {
+		t.Errorf("the filter received %d chunks after stopping the stream", chunks-len("Now is t"))
+	}
+
+	panicAtT := func(buf []byte, state interface{}) ([]byte, error) {
+		if buf[0] == 't' {
+			panic("OMG...")
+		}
+		return buf, nil
+	}
+	r = NewTransform(io.NopCloser(strings.NewReader(msg)), panicAtT, nil, 3, 1)
+	got, err = io.ReadAll(r)
+	if err == nil || string(got) != "Now is " {
+		t.Errorf("ReadAll of a panicking filter returned %q, %v", got, err)
+	}
+}
+
+func TestNewSourceError(t *testing.T) {
+	const msg = "Now is the time for all good gophers."
+	errBroken := errors.New("connection reset")
+	src := io.NopCloser(io.MultiReader(strings.NewReader(msg), iotest.ErrReader(errBroken)))
+	r := New(src, filterOk, new(myState), 3, 4)
+	got, err := io.ReadAll(r)
+	if string(got) != msg || err != errBroken {
+		t.Errorf("ReadAll() = %q, %v, want the data followed by the source error", got, err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != errBroken {
+		t.Errorf("reading past the end returned %d, %v", n, err)
+	}
+}
+
+// closeCounter counts the times the source was closed
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	// an endless source, the goroutine waits for the reader to receive data
+	src := &closeCounter{Reader: iotest.HalfReader(strings.NewReader(strings.Repeat("a", 1<<20)))}
+	r := New(src, filterOk, new(myState), 3, 16)
+	if _, err := io.ReadFull(r, make([]byte, 20)); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	r.WaitTillDone()
+	if err := r.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if src.closed != 1 {
+		t.Errorf("the source was closed %d times", src.closed)
+	}
+}
@@ -0,0 +1,79 @@
+package iomatch
+
+// An Aho-Corasick automaton finding any number of literal patterns in a single pass
+//
+// The automaton is compiled into a full transition table, such that each byte
+// of the stream costs a single table lookup regardless of the number of patterns.
+// The automaton is immutable once built and may be shared by many streams.
+type automaton struct {
+	next    [][256]int32 // the state reached from each state by each byte
+	outputs [][]int      // the patterns ending at each state, by index
+}
+
+func newAutomaton(patterns []string) *automaton {
+	a := &automaton{
+		next:    make([][256]int32, 1),
+		outputs: make([][]int, 1),
+	}
+
+	// build the trie, using -1 for missing edges
+	for i := range a.next[0] {
+		a.next[0][i] = -1
+	}
+	for index, pattern := range patterns {
+		state := int32(0)
+		for i := 0; i < len(pattern); i++ {
+			c := pattern[i]
+			if a.next[state][c] < 0 {
+				var edges [256]int32
+				for j := range edges {
+					edges[j] = -1
+				}
+				a.next = append(a.next, edges)
+				a.outputs = append(a.outputs, nil)
+				a.next[state][c] = int32(len(a.next) - 1)
+			}
+			state = a.next[state][c]
+		}
+		a.outputs[state] = append(a.outputs[state], index)
+	}
+
+	// complete the transitions using the failure links, breadth first
+	fail := make([]int32, len(a.next))
+	var queue []int32
+	for c := 0; c < 256; c++ {
+		if s := a.next[0][c]; s > 0 {
+			fail[s] = 0
+			queue = append(queue, s)
+		} else {
+			a.next[0][c] = 0
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		// patterns ending at the failure state also end here
+		a.outputs[state] = append(a.outputs[state], a.outputs[fail[state]]...)
+		for c := 0; c < 256; c++ {
+			if s := a.next[state][c]; s >= 0 {
+				fail[s] = a.next[fail[state]][c]
+				queue = append(queue, s)
+			} else {
+				a.next[state][c] = a.next[fail[state]][c]
+			}
+		}
+	}
+	return a
+}
+
+// scan() feeds buf to the automaton starting at state, calling found with the
+// index of each pattern ending at buf[i], and returns the state reached
+func (a *automaton) scan(state int32, buf []byte, found func(pattern int, i int)) int32 {
+	for i, c := range buf {
+		state = a.next[state][c]
+		for _, pattern := range a.outputs[state] {
+			found(pattern, i)
+		}
+	}
+	return state
+}
@@ -0,0 +1,236 @@
+// iomatch finds patterns in a stream of data arriving in chunks
+// It finds patterns straddling chunks and reports the offsets of matches
+// in the overall stream. It can be used on top of iofilter to inspect an
+// io.ReadCloser without buffering it.
+package iomatch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"github.com/IBM/go-security-plugs/iofilter"
+)
+
+// The default overlap window, the longest regular expression match guaranteed to be found across chunks
+const DefaultWindow = 1024
+
+// A Match is an occurrence of a pattern in a stream
+type Match struct {
+	Pattern string // the literal, or the regular expression, matched
+	Offset  int64  // the offset in the stream of the first byte of the match
+	Length  int    // the number of bytes matched
+}
+
+// Patterns is a compiled set of literals and regular expressions
+//
+// Patterns is immutable and may be shared by the matchers of many streams.
+type Patterns struct {
+	literals []string
+	ac       *automaton
+	regexps  []*regexp.Regexp
+	window   int
+}
+
+// Compile() compiles literals, searched using Aho-Corasick, and regular expressions
+//
+// Literals are found wherever they occur in the stream, regardless of chunk boundaries,
+// including overlapping occurrences.
+// Regular expressions are matched against the data of each chunk preceded by
+// the last window bytes of the stream, hence matches up to window bytes long are
+// found regardless of chunk boundaries. Regular expressions should not use anchors
+// (e.g. ^ or $), as they match chunk boundaries. Overlapping matches of the same
+// regular expression are reported once.
+// A window of 0 uses DefaultWindow.
+func Compile(literals []string, exprs []string, window int) (*Patterns, error) {
+	if window < 0 {
+		return nil, fmt.Errorf("iomatch illegal window %d", window)
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+	p := &Patterns{literals: literals, window: window}
+	for _, literal := range literals {
+		if literal == "" {
+			return nil, errors.New("iomatch empty literal")
+		}
+	}
+	if len(literals) > 0 {
+		p.ac = newAutomaton(literals)
+	}
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("iomatch %w", err)
+		}
+		p.regexps = append(p.regexps, re)
+	}
+	return p, nil
+}
+
+// A Matcher finds Patterns in a single stream
+//
+// Feed the chunks of the stream to Scan, in order, and call Flush at the end of the stream.
+// A Matcher is not safe for concurrent use.
+type Matcher struct {
+	patterns *Patterns
+	offset   int64         // the number of bytes scanned
+	state    int32         // the state of the automaton
+	tail     []byte        // the last bytes of the stream, up to the window
+	reported []int64       // the end offset of the last match of each regular expression
+	pending  map[int]Match // matches touching the end of the data, awaiting more data
+}
+
+// NewMatcher() creates a Matcher of a new stream
+func (p *Patterns) NewMatcher() *Matcher {
+	return &Matcher{patterns: p, reported: make([]int64, len(p.regexps))}
+}
+
+// Offset() returns the number of bytes scanned so far
+func (m *Matcher) Offset() int64 {
+	return m.offset
+}
+
+// Scan() scans the next chunk of the stream, returning the matches found, ordered by offset
+//
+// A regular expression match ending at the end of the chunk may continue in
+// the next chunk, hence it is reported by the next call to Scan or by Flush.
+func (m *Matcher) Scan(chunk []byte) []Match {
+	var matches []Match
+	if ac := m.patterns.ac; ac != nil {
+		base := m.offset
+		m.state = ac.scan(m.state, chunk, func(pattern int, i int) {
+			literal := m.patterns.literals[pattern]
+			matches = append(matches, Match{Pattern: literal, Offset: base + int64(i+1-len(literal)), Length: len(literal)})
+		})
+	}
+	if len(m.patterns.regexps) > 0 {
+		matches = append(matches, m.scanRegexps(chunk)...)
+	}
+	m.offset += int64(len(chunk))
+	sortMatches(matches)
+	return matches
+}
+
+// Flush() ends the stream, returning the matches awaiting more data
+func (m *Matcher) Flush() []Match {
+	var matches []Match
+	for _, match := range m.pending {
+		matches = append(matches, match)
+	}
+	m.pending = nil
+	sortMatches(matches)
+	return matches
+}
+
+// scanRegexps() matches the regular expressions against the tail followed by chunk
+func (m *Matcher) scanRegexps(chunk []byte) []Match {
+	buf := make([]byte, 0, len(m.tail)+len(chunk))
+	buf = append(append(buf, m.tail...), chunk...)
+	base := m.offset - int64(len(m.tail))
+	window := m.patterns.window
+
+	var matches []Match
+	pending := make(map[int]Match)
+	for index, re := range m.patterns.regexps {
+		// skip the data of the match already reported
+		skip := 0
+		if reported := m.reported[index] - base; reported > 0 {
+			skip = int(reported)
+		}
+		for _, loc := range re.FindAllIndex(buf[skip:], -1) {
+			start, end := skip+loc[0], skip+loc[1]
+			if end == start {
+				continue
+			}
+			match := Match{Pattern: re.String(), Offset: base + int64(start), Length: end - start}
+			if end == len(buf) && len(buf)-start <= window {
+				// the match may continue in the next chunk, and will be found again
+				pending[index] = match
+				break
+			}
+			m.reported[index] = base + int64(end)
+			matches = append(matches, match)
+		}
+	}
+	m.pending = pending
+
+	if len(buf) > window {
+		buf = buf[len(buf)-window:]
+	}
+	m.tail = append(m.tail[:0], buf...)
+	return matches
+}
+
+func sortMatches(matches []Match) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Offset < matches[j].Offset
+	})
+}
+
+// A MatchError is returned by the reader of a stream when onMatch stops the stream
+type MatchError struct {
+	Match Match
+	Err   error
+}
+
+func (e *MatchError) Error() string {
+	return fmt.Sprintf("iomatch %q at offset %d: %v", e.Match.Pattern, e.Match.Offset, e.Err)
+}
+
+func (e *MatchError) Unwrap() error {
+	return e.Err
+}
+
+// A reader delivering the data of a stream while matching it
+type reader struct {
+	*iofilter.Iofilter
+	matcher *Matcher
+	onMatch func(Match) error
+	err     error
+}
+
+// NewReader() wraps src using iofilter, such that the data is matched by m while it streams
+//
+// onMatch is called with each match, in order, once the data of the match was read from src.
+// When onMatch returns an error, the stream is stopped - the chunk holding the
+// end of the match is not delivered and reading returns a *MatchError.
+// The optional params are passed to iofilter.NewTransform.
+func NewReader(src io.ReadCloser, m *Matcher, onMatch func(Match) error, params ...uint) io.ReadCloser {
+	r := &reader{matcher: m, onMatch: onMatch}
+	r.Iofilter = iofilter.NewTransform(src, r.filter, nil, params...)
+	return r
+}
+
+func (r *reader) filter(buf []byte, state interface{}) ([]byte, error) {
+	if err := r.report(r.matcher.Scan(buf)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *reader) report(matches []Match) error {
+	for _, match := range matches {
+		if err := r.onMatch(match); err != nil {
+			return &MatchError{Match: match, Err: err}
+		}
+	}
+	return nil
+}
+
+func (r *reader) Read(dest []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.Iofilter.Read(dest)
+	if err == io.EOF {
+		// the stream ended, report the matches awaiting more data
+		if flushErr := r.report(r.matcher.Flush()); flushErr != nil {
+			r.err = flushErr
+			return n, flushErr
+		}
+	}
+	return n, err
+}
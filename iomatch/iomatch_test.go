@@ -0,0 +1,148 @@
+package iomatch
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// scanChunks() scans data in chunks of size bytes and returns all matches
+func scanChunks(p *Patterns, data string, size int) []Match {
+	m := p.NewMatcher()
+	var matches []Match
+	for start := 0; start < len(data); start += size {
+		end := start + size
+		if end > len(data) {
+			end = len(data)
+		}
+		matches = append(matches, m.Scan([]byte(data[start:end]))...)
+	}
+	return append(matches, m.Flush()...)
+}
+
+func TestCompile(t *testing.T) {
+	if _, err := Compile([]string{"a", ""}, nil, 0); err == nil {
+		t.Errorf("Compile accepted an empty literal")
+	}
+	if _, err := Compile(nil, []string{"a("}, 0); err == nil {
+		t.Errorf("Compile accepted an illegal regular expression")
+	}
+	if _, err := Compile(nil, nil, -1); err == nil {
+		t.Errorf("Compile accepted a negative window")
+	}
+	p, err := Compile(nil, nil, 0)
+	if err != nil || p.window != DefaultWindow {
+		t.Errorf("Compile() = %v, %v", p, err)
+	}
+}
+
+func TestLiterals(t *testing.T) {
+	p, err := Compile([]string{"EICAR", "CAR", "he", "she", "hers"}, nil, 0)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	data := "ushers drive an EICAR"
+	want := []Match{
+		{Pattern: "she", Offset: 1, Length: 3},
+		{Pattern: "he", Offset: 2, Length: 2},
+		{Pattern: "hers", Offset: 2, Length: 4},
+		{Pattern: "EICAR", Offset: 16, Length: 5},
+		{Pattern: "CAR", Offset: 18, Length: 3},
+	}
+	// every chunk size splits some of the literals differently
+	for size := 1; size <= len(data); size++ {
+		if got := scanChunks(p, data, size); !reflect.DeepEqual(got, want) {
+			t.Errorf("chunks of %d bytes: got %v, want %v", size, got, want)
+		}
+	}
+}
+
+func TestRegexps(t *testing.T) {
+	p, err := Compile(nil, []string{`[0-9]{4}-[0-9]{4}`, `x+`}, 16)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	data := "card 1234-5678 and xxxxxx, card 8765-4321 xx"
+	want := []Match{
+		{Pattern: `[0-9]{4}-[0-9]{4}`, Offset: 5, Length: 9},
+		{Pattern: `x+`, Offset: 19, Length: 6},
+		{Pattern: `[0-9]{4}-[0-9]{4}`, Offset: 32, Length: 9},
+		{Pattern: `x+`, Offset: 42, Length: 2},
+	}
+	for size := 1; size <= len(data); size++ {
+		if got := scanChunks(p, data, size); !reflect.DeepEqual(got, want) {
+			t.Errorf("chunks of %d bytes: got %v, want %v", size, got, want)
+		}
+	}
+
+	// matches longer than the window are only found within a chunk
+	data = strings.Repeat("x", 40)
+	if got := scanChunks(p, data, len(data)); len(got) != 1 || got[0].Length != 40 {
+		t.Errorf("a single chunk: got %v", got)
+	}
+	if got := scanChunks(p, data, 8); len(got) < 2 {
+		t.Errorf("chunks of 8 bytes: got %v, want the match longer than the window split", got)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	p, err := Compile([]string{"EICAR"}, []string{`secret=[a-z]+`}, 0)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	data := strings.Repeat("a", 8190) + "EICAR" + strings.Repeat("b", 10000) + "secret=abc"
+
+	var matches []Match
+	r := NewReader(io.NopCloser(strings.NewReader(data)), p.NewMatcher(), func(m Match) error {
+		matches = append(matches, m)
+		return nil
+	})
+	if err := iotest.TestReader(r, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	want := []Match{
+		{Pattern: "EICAR", Offset: 8190, Length: 5},
+		{Pattern: `secret=[a-z]+`, Offset: 18195, Length: 10},
+	}
+	// each match is reported once, even when reading past the end of the stream
+	if !reflect.DeepEqual(matches, want) {
+		t.Errorf("got %v, want %v", matches, want)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestNewReaderStop(t *testing.T) {
+	p, err := Compile([]string{"EICAR"}, []string{`secret=[a-z]+`}, 0)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	errFound := errors.New("found")
+	stop := func(m Match) error { return errFound }
+
+	data := strings.Repeat("a", 20000) + "EICAR" + strings.Repeat("b", 20000)
+	r := NewReader(io.NopCloser(strings.NewReader(data)), p.NewMatcher(), stop)
+	got, err := io.ReadAll(r)
+	var matchErr *MatchError
+	if !errors.As(err, &matchErr) || !errors.Is(err, errFound) || matchErr.Match.Offset != 20000 {
+		t.Errorf("ReadAll() error = %v", err)
+	}
+	if strings.Contains(string(got), "EICAR") || len(got) >= 20000 {
+		t.Errorf("read %d bytes of the stopped stream", len(got))
+	}
+
+	// a match pending at the end of the stream stops it once the data drains
+	data = strings.Repeat("a", 20000) + "secret=abc"
+	r = NewReader(io.NopCloser(strings.NewReader(data)), p.NewMatcher(), stop)
+	got, err = io.ReadAll(r)
+	if !errors.Is(err, errFound) || string(got) != data {
+		t.Errorf("read %d bytes with error %v", len(got), err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || !errors.Is(err, errFound) {
+		t.Errorf("reading past the end returned %d, %v", n, err)
+	}
+}
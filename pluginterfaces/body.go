@@ -0,0 +1,203 @@
+package pluginterfaces
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/IBM/go-security-plugs/iofilter"
+)
+
+// A BodyInspector receives the chunks of a body as they stream
+//
+// chunk is only valid during the call and must not be modified.
+// Returning an error aborts the stream.
+// A BodyInspector is called from a goroutine of its own, one chunk at a time.
+type BodyInspector func(chunk []byte) error
+
+// A BodyObserver observes a body as it streams
+//
+// All callbacks are optional and are called one at a time.
+type BodyObserver struct {
+	// OnChunk receives the chunks of the body as a BodyInspector does, returning an error aborts the stream
+	OnChunk BodyInspector
+	// OnEnd is called once the whole body was observed, before the end of the body is delivered.
+	// Returning an error aborts the stream, e.g. when a signature spans the whole body.
+	OnEnd func() error
+	// OnAbort is called once the stream is aborted by OnChunk or OnEnd, with the error they returned
+	OnAbort func(err error)
+}
+
+// The error returned when reading a body once its observer aborted the stream
+var ErrBodyAborted = errors.New("body aborted by inspector")
+
+// The state of a body being observed
+type bodyObservation struct {
+	mu       sync.Mutex
+	req      *http.Request // the request identifying the decision emitted when aborting
+	plug     string
+	observer BodyObserver
+	abort    func() // closes the connections carrying the body
+	aborted  bool
+	ended    bool
+}
+
+// A body sent through its observer, closing the original body when closed
+type observedBody struct {
+	*iofilter.Iofilter
+	observation *bodyObservation
+}
+
+// newObservedBody() wraps body, aborting closes the body unless bo.abort is set
+func newObservedBody(body io.ReadCloser, bo *bodyObservation) *observedBody {
+	b := &observedBody{observation: bo}
+	// the filter may abort as soon as the iofilter starts
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	b.Iofilter = iofilter.NewTransform(body, bo.filter, nil)
+	if bo.abort == nil {
+		bo.abort = func() { b.Close() }
+	}
+	return b
+}
+
+func (b *observedBody) Read(dest []byte) (int, error) {
+	n, err := b.Iofilter.Read(dest)
+	if err == io.EOF && !b.observation.end() {
+		return n, ErrBodyAborted
+	}
+	return n, err
+}
+
+// InspectRequestBody() wraps the body of req such that inspect receives the chunks
+// of the body while the body streams upstream
+//
+// The request returned should be returned by ApproveRequest, such that the
+// upstream receives the inspected body:
+//
+//	func (p *plug) ApproveRequest(req *http.Request) (*http.Request, error) {
+//		return pi.InspectRequestBody(req, p.name, func(chunk []byte) error {
+//			if bytes.Contains(chunk, []byte("EICAR")) {
+//				return errors.New("malware signature detected")
+//			}
+//			return nil
+//		}), nil
+//	}
+//
+// When inspect returns an error, the upload is aborted mid-stream by canceling
+// the context of the returned request, closing the connections to the client and
+// to the upstream, and a block decision is emitted on behalf of plug with the
+// error as its reason. Chunks are inspected before they are delivered upstream,
+// hence the chunk aborting the stream and the chunks following it are never delivered,
+// and reading the body returns ErrBodyAborted. No more chunks are sent to inspect once aborted.
+// The body starts streaming once wrapped, hence a plug using InspectRequestBody must
+// not set an rtplugs timeout - a late plug would read the body the upstream receives.
+// req is returned unchanged when it has no body.
+func InspectRequestBody(req *http.Request, plug string, inspect BodyInspector) *http.Request {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	out := req.WithContext(ctx)
+	bo := &bodyObservation{req: out, plug: plug, observer: BodyObserver{OnChunk: inspect}, abort: cancel}
+	out.Body = newObservedBody(req.Body, bo)
+	// the body can't be replayed through the inspector, disable retries
+	out.GetBody = nil
+	return out
+}
+
+// ObserveResponseBody() wraps the body of resp such that observer observes the
+// body while the body streams to the client
+//
+// The response returned should be returned by ApproveResponse:
+//
+//	func (p *plug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+//		h := sha256.New()
+//		return pi.ObserveResponseBody(resp, p.name, pi.BodyObserver{
+//			OnChunk: func(chunk []byte) error { h.Write(chunk); return nil },
+//			OnEnd:   func() error { return p.checkDigest(h.Sum(nil)) },
+//		}), nil
+//	}
+//
+// When OnChunk or OnEnd return an error, the stream is aborted: the connection
+// to the server is closed, reading the body returns ErrBodyAborted - which
+// closes the connection to the client, as it can no longer receive a complete
+// response - and a block decision is emitted on behalf of plug with the error as its reason.
+// Chunks are observed before they are delivered to the client, hence the chunk
+// aborting the stream and the chunks following it are never delivered.
+// resp is returned unchanged when it has no body.
+// As with InspectRequestBody, a plug using ObserveResponseBody must not set an rtplugs timeout.
+func ObserveResponseBody(resp *http.Response, plug string, observer BodyObserver) *http.Response {
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp
+	}
+	bo := &bodyObservation{req: resp.Request, plug: plug, observer: observer}
+	resp.Body = newObservedBody(resp.Body, bo)
+	return resp
+}
+
+// filter() sends buf to OnChunk, dropping buf and stopping the stream when OnChunk fails
+func (bo *bodyObservation) filter(buf []byte, state interface{}) ([]byte, error) {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	if bo.observer.OnChunk == nil {
+		return buf, nil
+	}
+	if err := protect(func() error { return bo.observer.OnChunk(buf) }); err != nil {
+		bo.abortStream(err)
+		return nil, ErrBodyAborted
+	}
+	return buf, nil
+}
+
+// end() calls OnEnd once, returning false when the stream was aborted
+func (bo *bodyObservation) end() bool {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	if bo.aborted {
+		return false
+	}
+	if bo.ended {
+		return true
+	}
+	bo.ended = true
+	if bo.observer.OnEnd == nil {
+		return true
+	}
+	if err := protect(bo.observer.OnEnd); err != nil {
+		bo.abortStream(err)
+		return false
+	}
+	return true
+}
+
+// abortStream() aborts the stream, bo.mu must be held
+func (bo *bodyObservation) abortStream(err error) {
+	bo.aborted = true
+	if bo.req != nil {
+		d := NewDecision(bo.req, bo.plug, PhaseAsync, VerdictBlock)
+		d.Reason = err.Error()
+		EmitDecision(d)
+	}
+	Log.Infof("Plug %s: aborting body: %v", bo.plug, err)
+	if bo.observer.OnAbort != nil {
+		protect(func() error {
+			bo.observer.OnAbort(err)
+			return nil
+		})
+	}
+	bo.abort()
+}
+
+// protect() calls f, turning a panic into an error such that a panicking observer aborts
+func protect(f func() error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("observer paniced: %v", recovered)
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,248 @@
+package pluginterfaces
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type collectSink struct {
+	mu        sync.Mutex
+	decisions []*Decision
+}
+
+func (s *collectSink) Emit(d *Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decisions = append(s.decisions, d)
+}
+
+func (s *collectSink) Close() error {
+	return nil
+}
+
+// closeCounter counts the times the body was closed
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestInspectRequestBody(t *testing.T) {
+	data := strings.Repeat("a", 20000)
+	src := &closeCounter{Reader: strings.NewReader(data)}
+	req := httptest.NewRequest("POST", "/upload", src)
+	var inspected bytes.Buffer
+	out := InspectRequestBody(req, "inspector", func(chunk []byte) error {
+		inspected.Write(chunk)
+		return nil
+	})
+	if out.GetBody != nil {
+		t.Errorf("InspectRequestBody kept GetBody")
+	}
+	got, err := io.ReadAll(out.Body)
+	if err != nil || string(got) != data {
+		t.Errorf("read %d bytes with error %v, want %d bytes", len(got), err, len(data))
+	}
+	if inspected.String() != data {
+		t.Errorf("inspected %d bytes, want %d bytes", inspected.Len(), len(data))
+	}
+	if out.Context().Err() != nil {
+		t.Errorf("the request was canceled")
+	}
+	out.Body.Close()
+	if src.closed != 1 {
+		t.Errorf("the original body was closed %d times", src.closed)
+	}
+
+	for _, body := range []io.Reader{nil, http.NoBody} {
+		req := httptest.NewRequest("GET", "/", body)
+		if out := InspectRequestBody(req, "inspector", nil); out != req {
+			t.Errorf("InspectRequestBody modified a request without a body")
+		}
+	}
+}
+
+func TestInspectRequestBodyAbort(t *testing.T) {
+	sink := new(collectSink)
+	SetDecisionSink(sink)
+	defer SetDecisionSink(nil)
+
+	inspectors := map[string]BodyInspector{
+		"error": func(chunk []byte) error {
+			if bytes.IndexByte(chunk, 'X') >= 0 {
+				return errors.New("found X")
+			}
+			return nil
+		},
+		"panic": func(chunk []byte) error {
+			if bytes.IndexByte(chunk, 'X') >= 0 {
+				panic("found X")
+			}
+			return nil
+		},
+	}
+	for name, inspect := range inspectors {
+		t.Run(name, func(t *testing.T) {
+			sink.decisions = nil
+			data := strings.Repeat("a", 10000) + "X" + strings.Repeat("a", 30000)
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(data))
+			calls := 0
+			out := InspectRequestBody(req, "inspector", func(chunk []byte) error {
+				calls++
+				return inspect(chunk)
+			})
+			got, err := io.ReadAll(out.Body)
+			if !errors.Is(err, ErrBodyAborted) {
+				t.Errorf("reading an aborted body returned %v", err)
+			}
+			if bytes.IndexByte(got, 'X') >= 0 || len(got) >= len(data) {
+				t.Errorf("read %d bytes of the aborted body", len(got))
+			}
+			if out.Context().Err() == nil {
+				t.Errorf("the request was not canceled")
+			}
+			if calls != 2 {
+				t.Errorf("the inspector was called %d times, want 2", calls)
+			}
+			if len(sink.decisions) != 1 || sink.decisions[0].Plug != "inspector" || sink.decisions[0].Verdict != VerdictBlock {
+				t.Errorf("expected a block decision, got %v", sink.decisions)
+			}
+		})
+	}
+}
+
+func TestObserveResponseBody(t *testing.T) {
+	data := strings.Repeat("a", 20000)
+	src := &closeCounter{Reader: strings.NewReader(data)}
+	resp := &http.Response{StatusCode: http.StatusOK, Body: src}
+	var observed bytes.Buffer
+	ends := 0
+	out := ObserveResponseBody(resp, "observer", BodyObserver{
+		OnChunk: func(chunk []byte) error {
+			observed.Write(chunk)
+			return nil
+		},
+		OnEnd: func() error {
+			ends++
+			return nil
+		},
+		OnAbort: func(err error) {
+			t.Errorf("OnAbort called with %v", err)
+		},
+	})
+	got, err := io.ReadAll(out.Body)
+	if err != nil || string(got) != data || observed.String() != data {
+		t.Errorf("read %d bytes with error %v and observed %d bytes, want %d bytes", len(got), err, observed.Len(), len(data))
+	}
+	if n, err := out.Body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("reading past the end returned %d, %v", n, err)
+	}
+	if ends != 1 {
+		t.Errorf("OnEnd was called %d times", ends)
+	}
+	out.Body.Close()
+	if src.closed != 1 {
+		t.Errorf("the original body was closed %d times", src.closed)
+	}
+
+	if ObserveResponseBody(nil, "observer", BodyObserver{}) != nil {
+		t.Errorf("ObserveResponseBody of a nil response returned a response")
+	}
+	resp = &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}
+	if out := ObserveResponseBody(resp, "observer", BodyObserver{}); out.Body != http.NoBody {
+		t.Errorf("ObserveResponseBody wrapped an empty body")
+	}
+}
+
+func TestObserveResponseBodyAbort(t *testing.T) {
+	sink := new(collectSink)
+	SetDecisionSink(sink)
+	defer SetDecisionSink(nil)
+
+	data := strings.Repeat("a", 10000) + "X" + strings.Repeat("a", 30000)
+	observers := map[string]BodyObserver{
+		"chunk": {OnChunk: func(chunk []byte) error {
+			if bytes.IndexByte(chunk, 'X') >= 0 {
+				return errors.New("found X")
+			}
+			return nil
+		}},
+		"end": {OnEnd: func() error {
+			return errors.New("bad digest")
+		}},
+	}
+	for name, observer := range observers {
+		t.Run(name, func(t *testing.T) {
+			sink.decisions = nil
+			var aborted error
+			observer.OnAbort = func(err error) { aborted = err }
+			src := &closeCounter{Reader: strings.NewReader(data)}
+			req := httptest.NewRequest("GET", "/download", nil)
+			resp := &http.Response{StatusCode: http.StatusOK, Body: src, Request: req}
+			out := ObserveResponseBody(resp, "observer", observer)
+
+			_, err := io.ReadAll(out.Body)
+			if !errors.Is(err, ErrBodyAborted) {
+				t.Errorf("reading an aborted body returned %v", err)
+			}
+			if aborted == nil {
+				t.Errorf("OnAbort was not called")
+			}
+			if src.closed != 1 {
+				t.Errorf("the original body was closed %d times", src.closed)
+			}
+			if len(sink.decisions) != 1 || sink.decisions[0].Reason != aborted.Error() || sink.decisions[0].Path != "/download" {
+				t.Errorf("expected a block decision, got %v", sink.decisions)
+			}
+		})
+	}
+}
+
+// The client of a reverse proxy aborting a response can't receive a complete response
+func TestObserveResponseBodyProxy(t *testing.T) {
+	data := strings.Repeat("a", 100000) + "X"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(data))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		ObserveResponseBody(resp, "observer", BodyObserver{OnChunk: func(chunk []byte) error {
+			if bytes.IndexByte(chunk, 'X') >= 0 {
+				return errors.New("found X")
+			}
+			return nil
+		}})
+		return nil
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatalf("Get returned %v", err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("the client received a complete response of %d bytes", len(got))
+	}
+	if bytes.IndexByte(got, 'X') >= 0 {
+		t.Errorf("the client received the chunk aborting the response")
+	}
+}
@@ -0,0 +1,112 @@
+package pluginterfaces
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The phase in which a security decision was taken
+const (
+	PhaseRequest  = "request"  // during ApproveRequest
+	PhaseResponse = "response" // during ApproveResponse
+	PhaseAsync    = "async"    // asynchroniously, e.g. when a plug cancels a request mid-way
+)
+
+// The verdict of a security decision
+const (
+	VerdictAllow      = "allow"      // the plug approved
+	VerdictBlock      = "block"      // the plug blocked, or failed and the plug fails closed
+	VerdictWouldBlock = "wouldblock" // the plug blocked while in monitor mode
+	VerdictSkip       = "skip"       // the plug failed and was skipped as the plug fails open
+)
+
+// A Decision is a machine readable record of a security decision taken by a plug
+type Decision struct {
+	Time      time.Time     `json:"time"`
+	Plug      string        `json:"plug"`
+	Phase     string        `json:"phase"`
+	Verdict   string        `json:"verdict"`
+	Reason    string        `json:"reason,omitempty"`
+	Latency   time.Duration `json:"latencyNs"`
+	RequestID string        `json:"requestId,omitempty"`
+	Method    string        `json:"method,omitempty"`
+	Host      string        `json:"host,omitempty"`
+	Path      string        `json:"path,omitempty"`
+	Service   string        `json:"service,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+}
+
+// A DecisionSink receives the decisions of rtplugs and all connected plugs
+//
+// Emit should not block the caller for long, as it is called while requests are processed.
+type DecisionSink interface {
+	Emit(d *Decision)
+	Close() error
+}
+
+// The sink for the decisions of rtplugs and all connected plugs
+// When nil, decisions are discarded
+var decisions struct {
+	mu   sync.RWMutex
+	sink DecisionSink
+}
+
+// SetDecisionSink() sets the sink for the decisions of rtplugs and all connected plugs
+// A nil sink discards decisions.
+func SetDecisionSink(sink DecisionSink) {
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	decisions.sink = sink
+}
+
+// ReplaceDecisionSink() sets sink in place of old, only when old is the current sink
+func ReplaceDecisionSink(old DecisionSink, sink DecisionSink) bool {
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	if decisions.sink != old {
+		return false
+	}
+	decisions.sink = sink
+	return true
+}
+
+// CurrentDecisionSink() returns the sink for the decisions, or nil when decisions are discarded
+func CurrentDecisionSink() DecisionSink {
+	decisions.mu.RLock()
+	defer decisions.mu.RUnlock()
+	return decisions.sink
+}
+
+// NewDecision() creates a Decision about req, identifying the request by its
+// method, host, path and X-Request-Id header
+func NewDecision(req *http.Request, plug string, phase string, verdict string) *Decision {
+	d := &Decision{
+		Time:    time.Now(),
+		Plug:    plug,
+		Phase:   phase,
+		Verdict: verdict,
+	}
+	if req != nil {
+		d.RequestID = req.Header.Get("X-Request-Id")
+		d.Method = req.Method
+		d.Host = req.Host
+		if req.URL != nil {
+			d.Path = req.URL.Path
+			if d.Host == "" {
+				d.Host = req.URL.Host
+			}
+		}
+	}
+	return d
+}
+
+// EmitDecision() sends d to the decision sink, if one is set
+//
+// d may be emitted while the sink is being replaced, hence a sink should
+// ignore decisions emitted after it was closed.
+func EmitDecision(d *Decision) {
+	if sink := CurrentDecisionSink(); sink != nil {
+		sink.Emit(d)
+	}
+}
@@ -0,0 +1,42 @@
+package pluginterfaces
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestDecisionSink(t *testing.T) {
+	defer SetDecisionSink(nil)
+	first, second := new(collectSink), new(collectSink)
+	req := httptest.NewRequest("GET", "/path", nil)
+
+	// decisions are emitted while the sink is replaced
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				EmitDecision(NewDecision(req, "plug", PhaseAsync, VerdictBlock))
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		SetDecisionSink(first)
+		SetDecisionSink(nil)
+	}
+	wg.Wait()
+
+	SetDecisionSink(first)
+	if ReplaceDecisionSink(second, nil) || CurrentDecisionSink() != first {
+		t.Errorf("ReplaceDecisionSink replaced a sink other than the current sink")
+	}
+	if !ReplaceDecisionSink(first, second) || CurrentDecisionSink() != second {
+		t.Errorf("ReplaceDecisionSink did not replace the current sink")
+	}
+	EmitDecision(NewDecision(req, "plug", PhaseAsync, VerdictBlock))
+	if len(second.decisions) != 1 || second.decisions[0].Path != "/path" {
+		t.Errorf("expected a decision, got %v", second.decisions)
+	}
+}
@@ -3,6 +3,7 @@ package pluginterfaces
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"go.uber.org/zap"
@@ -34,14 +35,101 @@ type RoundTripPlug interface {
 	ApproveResponse(*http.Request, *http.Response) (*http.Response, error)
 }
 
+// A plug able to report a failure to initialize offers this interface
+//
+// rtplugs calls Initialize instead of Init when the plug offers it.
+// Initialize returns an error when the plug can't be initialized, e.g. when
+// its config is illegal, instead of panicking.
+type Initializer interface {
+	Initialize(ctx context.Context, c map[string]string, serviceName string, namespace string, logger Logger) (context.Context, error)
+}
+
+// A plug supporting changes to its config while active offers this interface
+//
+// Reconfigure is called with the new config of the plug while requests are
+// being approved. Requests already in flight should keep using the old config,
+// e.g. by atomically swapping the state derived from the config.
+// When Reconfigure returns an error, the plug should keep its old config.
+type Reconfigurable interface {
+	Reconfigure(c map[string]string) error
+}
+
+// A plug able to report whether it can make sound decisions offers this interface
+//
+// Health is called periodically and should return an error when the plug can no
+// longer make sound decisions, e.g. when its certificates expired or its rules are stale.
+// Health should return once ctx is done.
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+// A plug declaring where it belongs in the chain offers this interface
+//
+// rtplugs orders the chain by priority, lowest first, keeping the order of the
+// plug list for plugs of the same priority. Plugs not offering this interface
+// have priority 0. Requests are approved in chain order and responses in reverse order,
+// e.g. an authentication plug (priority -100) approves requests before a rate limiting
+// plug (priority 0), which approves requests before a content inspection plug (priority 100).
+// The priority may be overridden using the "priority" config key reserved by rtplugs.
+type Prioritizer interface {
+	PlugPriority() int
+}
+
+// A BlockError may be returned by ApproveRequest or ApproveResponse to block
+// the request and let the plug decide what the client receives.
+//
+// rtplugs turns a BlockError into a response carrying StatusCode, Header and Body.
+// Any other error results in the client receiving a 502 response code.
+type BlockError struct {
+	StatusCode int         // defaults to 403 (Forbidden)
+	Header     http.Header // optional headers, e.g. WWW-Authenticate or Retry-After
+	Body       string      // optional response body
+	Reason     string      // optional reason used for logging, not sent to the client
+}
+
+// NewBlockError(statusCode, reason) creates a BlockError with an empty body
+func NewBlockError(statusCode int, reason string) *BlockError {
+	return &BlockError{StatusCode: statusCode, Header: make(http.Header), Reason: reason}
+}
+
+func (e *BlockError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("blocked with status %d", e.Status())
+	}
+	return fmt.Sprintf("blocked with status %d: %s", e.Status(), e.Reason)
+}
+
+// Status() returns the status code to be sent to the client
+func (e *BlockError) Status() int {
+	if e.StatusCode == 0 {
+		return http.StatusForbidden
+	}
+	return e.StatusCode
+}
+
 func init() {
 	logger, _ := zap.NewDevelopment()
 	Log = logger.Sugar()
 }
 
-var RoundTripPlugs []RoundTripPlug
+// The constructors of all registered plugs, by plug name
+var RoundTripPlugs = make(map[string]func() RoundTripPlug)
 
 // RegisterPlug() is called from init() function of plugs
-func RegisterPlug(p RoundTripPlug) {
-	RoundTripPlugs = append(RoundTripPlugs, p)
+//
+// newPlug is a constructor called to create a new instance of the plug
+// each time the plug is activated. Instances should not share configuration.
+// Registering a plug name which is already registered replaces the constructor.
+//
+// A typical plug would use:
+//		func NewPlug() pi.RoundTripPlug {
+//			return &plug{name: name, version: version}
+//		}
+//
+//		func init() {
+//			pi.RegisterPlug(NewPlug)
+//		}
+func RegisterPlug(newPlug func() RoundTripPlug) {
+	p := newPlug()
+	RoundTripPlugs[p.PlugName()] = newPlug
 }
@@ -0,0 +1,106 @@
+package pluginterfaces
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The type of a config value
+const (
+	TypeString   = "string"   // any value (default)
+	TypeInt      = "int"      // an integer such as "3"
+	TypeBool     = "bool"     // "true" or "false"
+	TypeDuration = "duration" // a duration such as "100ms"
+)
+
+// A ConfigKey declares a key in the config of a plug
+type ConfigKey struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`        // defaults to TypeString
+	Default     string `json:"default,omitempty"`     // set when the key is missing
+	Required    bool   `json:"required,omitempty"`    // a missing key is an error
+	Description string `json:"description,omitempty"` // used for documentation
+}
+
+// A ConfigSchema declares the config keys of a plug
+type ConfigSchema struct {
+	Keys   []ConfigKey `json:"keys"`
+	Strict bool        `json:"strict,omitempty"` // reject unknown keys, instead of warning about them
+}
+
+// A plug declaring its config keys offers this interface
+//
+// rtplugs validates the config of the plug against the schema before calling
+// Init (or Initialize) and Reconfigure, and passes the config with defaults set.
+// Keys reserved by rtplugs (e.g. "mode") need not be declared.
+type ConfigSchemer interface {
+	ConfigSchema() ConfigSchema
+}
+
+// Validate() checks the types of the keys in c and that required keys are set,
+// returning a copy of c with the defaults of missing keys set
+func (s ConfigSchema) Validate(c map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(c)+len(s.Keys))
+	for k, v := range c {
+		out[k] = v
+	}
+	for _, key := range s.Keys {
+		v, ok := c[key.Name]
+		if !ok {
+			if key.Required {
+				return nil, fmt.Errorf("missing required config key %q", key.Name)
+			}
+			if key.Default != "" {
+				out[key.Name] = key.Default
+			}
+			continue
+		}
+		if err := checkType(key.Type, v); err != nil {
+			return nil, fmt.Errorf("config key %q: %v", key.Name, err)
+		}
+	}
+	return out, nil
+}
+
+// Unknown() returns the sorted keys of c not declared by the schema
+func (s ConfigSchema) Unknown(c map[string]string) []string {
+	var unknown []string
+	for k := range c {
+		if s.Key(k) == nil {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Key() returns the declaration of the key name, or nil when not declared
+func (s ConfigSchema) Key(name string) *ConfigKey {
+	for i := range s.Keys {
+		if s.Keys[i].Name == name {
+			return &s.Keys[i]
+		}
+	}
+	return nil
+}
+
+func checkType(t string, v string) error {
+	var err error
+	switch t {
+	case "", TypeString:
+	case TypeInt:
+		_, err = strconv.Atoi(v)
+	case TypeBool:
+		_, err = strconv.ParseBool(v)
+	case TypeDuration:
+		_, err = time.ParseDuration(v)
+	default:
+		return fmt.Errorf("unknown type %q", t)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a %s", v, t)
+	}
+	return nil
+}
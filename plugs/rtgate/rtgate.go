@@ -69,6 +69,9 @@ func (p *plug) ApproveRequest(req *http.Request) (*http.Request, error) {
 			pi.Log.Infof("Done!")
 		case <-time.After(timeout):
 			pi.Log.Infof("Timeout!")
+			d := pi.NewDecision(req, p.name, pi.PhaseAsync, pi.VerdictBlock)
+			d.Reason = "request canceled after " + timeout.String()
+			pi.EmitDecision(d)
 			cancelFunction()
 		}
 	}(newCtx, cancelFunction, req, timeout)
@@ -111,6 +114,7 @@ func (p *plug) Start(ctx context.Context) context.Context {
 	return ctx
 }
 
+// Init() ignores the config c, as the plug is configured using env RT_GATE_*
 func (p *plug) Init(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) context.Context {
 	p.config = c
 	pi.Log.Infof("plug %s: Never use in production", p.name)
@@ -128,9 +132,14 @@ func (p *plug) Init(ctx context.Context, c map[string]string, serviceName string
 	return ctx
 }
 
-func init() {
+// NewPlug() creates a new instance of the plug
+func NewPlug() pi.RoundTripPlug {
 	p := new(plug)
 	p.version = version
 	p.name = name
-	pi.RegisterPlug(p)
+	return p
+}
+
+func init() {
+	pi.RegisterPlug(NewPlug)
 }
@@ -22,10 +22,8 @@ func (d dLog) Sync() error                               { return nil }
 var defaultLog dLog
 
 func testinit() *plug {
-	p := new(plug)
-	p.version = version
-	p.name = name
-	pi.RegisterPlug(p)
+	p := NewPlug().(*plug)
+	pi.RegisterPlug(NewPlug)
 	p.Init(context.Background(), nil, "svcName", "myns", defaultLog)
 	return p
 }
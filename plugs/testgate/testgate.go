@@ -3,6 +3,7 @@ package testgate
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 
 	pi "github.com/IBM/go-security-plugs/pluginterfaces"
 )
@@ -15,12 +16,17 @@ type plug struct {
 	version string
 	config  map[string]string
 
-	sender string
-	answer string
+	settings atomic.Value // the current *settings, swapped by Reconfigure
 
 	// Add here any other state the extension needs
 }
 
+// The settings derived from the plug config
+type settings struct {
+	sender string
+	answer string
+}
+
 func (p *plug) PlugName() string {
 	return p.name
 }
@@ -31,14 +37,14 @@ func (p *plug) PlugVersion() string {
 
 func (p *plug) ApproveRequest(req *http.Request) (*http.Request, error) {
 	if _, ok := req.Header["X-Testgate-Hi"]; ok {
-		pi.Log.Infof("Plug %s: hehe, %s noticed me!", p.name, p.sender)
+		pi.Log.Infof("Plug %s: hehe, %s noticed me!", p.name, p.current().sender)
 	}
 	return req, nil
 }
 
 func (p *plug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
 	if _, ok := req.Header["X-Testgate-Hi"]; ok {
-		resp.Header.Add("X-Testgate-Bye", p.answer)
+		resp.Header.Add("X-Testgate-Bye", p.current().answer)
 	}
 	return resp, nil
 }
@@ -55,24 +61,52 @@ func (p *plug) Init(ctx context.Context, c map[string]string, serviceName string
 	p.config = c
 
 	pi.Log.Infof("Plug %s: Never use in production", p.name)
-	p.answer = "CU"
-	p.sender = "someone"
-	if p.config != nil {
-		if v, ok := p.config["sender"]; ok {
-			p.sender = v
-			pi.Log.Debugf("Plug %s: found sender %s", p.name, p.sender)
+	p.settings.Store(p.parseConfig(c))
+	return ctx
+}
+
+// Reconfigure() swaps the settings, requests in flight keep the old settings
+func (p *plug) Reconfigure(c map[string]string) error {
+	p.settings.Store(p.parseConfig(c))
+	return nil
+}
+
+// ConfigSchema() declares the config keys read by parseConfig
+func (p *plug) ConfigSchema() pi.ConfigSchema {
+	return pi.ConfigSchema{Keys: []pi.ConfigKey{
+		{Name: "sender", Default: "someone", Description: "the name logged when a request carries X-Testgate-Hi"},
+		{Name: "response", Default: "CU", Description: "the value of X-Testgate-Bye added to the response"},
+	}}
+}
+
+func (p *plug) current() *settings {
+	return p.settings.Load().(*settings)
+}
+
+func (p *plug) parseConfig(c map[string]string) *settings {
+	s := &settings{answer: "CU", sender: "someone"}
+	if c != nil {
+		if v, ok := c["sender"]; ok {
+			s.sender = v
+			pi.Log.Debugf("Plug %s: found sender %s", p.name, s.sender)
 		}
-		if v, ok := p.config["response"]; ok {
-			p.answer = v
-			pi.Log.Debugf("Plug %s: found answer %s", p.name, p.answer)
+		if v, ok := c["response"]; ok {
+			s.answer = v
+			pi.Log.Debugf("Plug %s: found answer %s", p.name, s.answer)
 		}
 	}
-	return ctx
+	return s
 }
 
-func init() {
+// NewPlug() creates a new instance of the plug
+func NewPlug() pi.RoundTripPlug {
 	p := new(plug)
 	p.version = version
 	p.name = name
-	pi.RegisterPlug(p)
+	p.settings.Store(p.parseConfig(nil))
+	return p
+}
+
+func init() {
+	pi.RegisterPlug(NewPlug)
 }
@@ -22,10 +22,8 @@ func (d dLog) Sync() error                               { return nil }
 var defaultLog dLog
 
 func testinit() *plug {
-	p := new(plug)
-	p.version = version
-	p.name = name
-	pi.RegisterPlug(p)
+	p := NewPlug().(*plug)
+	pi.RegisterPlug(NewPlug)
 	p.Init(context.Background(), nil, "svcName", "myns", defaultLog)
 	return p
 }
@@ -164,3 +162,32 @@ func Test_plug_ApproveRequest(t *testing.T) {
 	})
 
 }
+
+func Test_plug_Reconfigure(t *testing.T) {
+	p := testinit()
+	req := httptest.NewRequest("GET", "/some/path", nil)
+	req.Header.Set("X-Testgate-Hi", "value")
+
+	if err := p.Reconfigure(map[string]string{"response": "later"}); err != nil {
+		t.Errorf("Reconfigure error %v! ", err)
+	}
+	resp := httptest.NewRecorder().Result()
+	if _, err := p.ApproveResponse(req, resp); err != nil {
+		t.Errorf("ApproveResponse error %v! ", err)
+	}
+	if got := resp.Header.Get("X-Testgate-Bye"); got != "later" {
+		t.Errorf("ApproveResponse said %q, want the reconfigured answer", got)
+	}
+}
+
+func Test_plug_ConfigSchema(t *testing.T) {
+	p := testinit()
+	c, err := p.ConfigSchema().Validate(nil)
+	if err != nil {
+		t.Fatalf("Validate error %v! ", err)
+	}
+	s := p.parseConfig(c)
+	if want := p.parseConfig(nil); *s != *want {
+		t.Errorf("schema defaults %v differ from the parseConfig defaults %v", *s, *want)
+	}
+}
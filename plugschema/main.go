@@ -0,0 +1,107 @@
+// Command plugschema prints the config keys declared by plugs, for documentation
+//
+// Usage:
+//
+//	plugschema [-json] [-dir <dir>] [plug...]
+//
+// The schemas of the named plugs are printed, or of all plugs when none are named.
+// Plugs imported by this command are always available; plugs built as .so files
+// are loaded from dir.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+	_ "github.com/IBM/go-security-plugs/plugs/rtgate"
+	_ "github.com/IBM/go-security-plugs/plugs/testgate"
+	"github.com/IBM/go-security-plugs/rtplugs"
+)
+
+// The schema of a plug, as printed using -json
+type plugSchema struct {
+	Plug    string           `json:"plug"`
+	Version string           `json:"version"`
+	Schema  *pi.ConfigSchema `json:"schema,omitempty"` // nil when the plug declares no schema
+}
+
+func main() {
+	asJSON := flag.Bool("json", false, "print the schemas as JSON")
+	dir := flag.String("dir", os.Getenv("RTPLUGS_DIR"), "a directory of .so plugs to load")
+	flag.Parse()
+
+	if *dir != "" {
+		if err := rtplugs.LoadPlugs(*dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	names := flag.Args()
+	if len(names) == 0 {
+		for name := range pi.RoundTripPlugs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var schemas []plugSchema
+	for _, name := range names {
+		newPlug, ok := pi.RoundTripPlugs[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "plug %s is not supported\n", name)
+			os.Exit(1)
+		}
+		p := newPlug()
+		ps := plugSchema{Plug: name, Version: p.PlugVersion()}
+		if schemer, ok := p.(pi.ConfigSchemer); ok {
+			schema := schemer.ConfigSchema()
+			ps.Schema = &schema
+		}
+		schemas = append(schemas, ps)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(schemas); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	for _, ps := range schemas {
+		printSchema(os.Stdout, ps)
+	}
+}
+
+func printSchema(out io.Writer, ps plugSchema) {
+	fmt.Fprintf(out, "%s %s\n", ps.Plug, ps.Version)
+	switch {
+	case ps.Schema == nil:
+		fmt.Fprintf(out, "  no schema declared\n\n")
+		return
+	case len(ps.Schema.Keys) == 0:
+		fmt.Fprintf(out, "  no config keys\n")
+	default:
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "  KEY\tTYPE\tDEFAULT\tREQUIRED\tDESCRIPTION\n")
+		for _, key := range ps.Schema.Keys {
+			t := key.Type
+			if t == "" {
+				t = pi.TypeString
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%t\t%s\n", key.Name, t, key.Default, key.Required, key.Description)
+		}
+		w.Flush()
+	}
+	if ps.Schema.Strict {
+		fmt.Fprintf(out, "  unknown keys are rejected\n")
+	}
+	fmt.Fprintln(out)
+}
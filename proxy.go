@@ -30,6 +30,8 @@ func main() {
 	os.Setenv("SERVING_NAMESPACE", "default")
 	os.Setenv("SERVING_SERVICE", "myserver")
 	os.Setenv("RTPLUGS", "testgate")
+	// Serve the state of the plugs on a separate admin port, reachable from this host only
+	os.Setenv("RTPLUGS_ADMIN_ADDR", "127.0.0.1:8082")
 	//rt := rtplugs.New(log)
 	//if rt != nil {
 	//	defer rt.Close()
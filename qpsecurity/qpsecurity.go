@@ -2,8 +2,11 @@ package qpsecurity
 
 import (
 	"bufio"
+	"bytes"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/IBM/go-security-plugs/rtplugs"
 	"knative.dev/serving/pkg/queue/sharedmain"
@@ -14,30 +17,77 @@ type QPSecurityPlugs struct {
 	config   map[string]map[string]string
 	defaults *sharedmain.Defaults
 	plugs    []string
+	admin    *http.Server // the admin server, when RTPLUGS_ADMIN_ADDR is set
 }
 
 func NewQPSecurityPlugs() *QPSecurityPlugs {
 	return new(QPSecurityPlugs)
 }
 
+// The pod annotations, mounted using the downward API
+const annotationsFile = "/etc/podinfo/annotations"
+
+// How often the annotations file is checked for changes
+const annotationsPollInterval = 10 * time.Second
+
+// ProcessAnnotations() builds the plug list and config from the pod annotations
 func (p *QPSecurityPlugs) ProcessAnnotations() {
-	file, err := os.Open("/etc/podinfo/annotations")
+	data, err := os.ReadFile(annotationsFile)
+	if err != nil {
+		p.defaults.Logger.Infof("Failed to open %s. Check if podInfo is mounted. os.ReadFile Error %s", annotationsFile, err.Error())
+		return
+	}
+	p.plugs, p.config, err = ParseAnnotations(data)
 	if err != nil {
-		p.defaults.Logger.Infof("Failed to open /etc/podinfo/annotations. Check if podInfo is mounted. os.Open Error %s", err.Error())
+		p.defaults.Logger.Infof("Scanner Error %s", err.Error())
 		return
 	}
-	defer file.Close()
-	p.config = make(map[string]map[string]string)
-	p.plugs = make([]string, 0)
+	p.defaults.Logger.Debugf("Plug: %v was activated with config %v", p.plugs, p.config)
+}
+
+// ProcessConfigFile() builds the plug list and config from a plug chain config file (see rtplugs.ChainConfig)
+func (p *QPSecurityPlugs) ProcessConfigFile(path string) error {
+	cc, err := rtplugs.LoadChainConfig(path)
+	if err != nil {
+		return err
+	}
+	p.plugs, p.config = cc.PlugsAndConfig()
+	p.defaults.Logger.Debugf("Plug: %v was activated with config %v", p.plugs, p.config)
+	return nil
+}
+
+// Route keys of rtplugs whose values are kept as is - lower casing a path pattern
+// would let requests to mixed case paths bypass the plug
+var caseSensitiveKeys = map[string]bool{
+	"matchpath":   true,
+	"matchhost":   true,
+	"matchmethod": true,
+	"matchheader": true,
+	"skippath":    true,
+}
+
+// ParseAnnotations() parses the content of the annotations file into a plug list and config
+//
+// A plug is activated using `qpextention.knative.dev/<plug>-activate=enable`
+// A plug is configured using `qpextention.knative.dev/<plug>-config-<key>=<value>`
+// Keys reserved by rtplugs (e.g. `qpextention.knative.dev/<plug>-config-mode=monitor`)
+// set the policy rtplugs applies when calling the plug
+// Annotation names and values are lower cased, except for the values of route keys
+// (e.g. `qpextention.knative.dev/<plug>-config-matchpath=/API/Upload`)
+func ParseAnnotations(data []byte) (plugs []string, config map[string]map[string]string, err error) {
+	config = make(map[string]map[string]string)
+	plugs = make([]string, 0)
 
 	qpextentionPreifx := "qpextention.knative.dev/"
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		txt := scanner.Text()
-		txt = strings.ToLower(txt)
-		parts := strings.Split(txt, "=")
+		parts := strings.SplitN(txt, "=", 2)
+		if len(parts) < 2 {
+			continue
+		}
 
-		k := parts[0]
+		k := strings.ToLower(parts[0])
 		v := parts[1]
 		if strings.HasPrefix(k, qpextentionPreifx) && len(k) > len(qpextentionPreifx) {
 			v = strings.TrimSuffix(strings.TrimPrefix(v, "\""), "\"")
@@ -53,23 +103,23 @@ func (p *QPSecurityPlugs) ProcessAnnotations() {
 				if !strings.EqualFold(v, "enable") {
 					continue
 				}
-				p.plugs = append(p.plugs, extension)
+				plugs = append(plugs, extension)
 			case "config":
 				if len(keyparts) == 3 {
 					extensionKey := keyparts[2]
-					if _, ok := p.config[extension]; !ok {
-						p.config[extension] = make(map[string]string)
+					if _, ok := config[extension]; !ok {
+						config[extension] = make(map[string]string)
 					}
-					p.config[extension][extensionKey] = v
+					if !caseSensitiveKeys[extensionKey] {
+						v = strings.ToLower(v)
+					}
+					config[extension][extensionKey] = v
 				}
 			}
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		p.defaults.Logger.Infof("Scanner Error %s", err.Error())
-		return
-	}
-	p.defaults.Logger.Debugf("Plug: %v was activated with config %v", p.plugs, p.config)
+	err = scanner.Err()
+	return
 }
 
 func (p *QPSecurityPlugs) Setup(defaults *sharedmain.Defaults) {
@@ -79,18 +129,73 @@ func (p *QPSecurityPlugs) Setup(defaults *sharedmain.Defaults) {
 		servicename = defaults.Env.ServingConfiguration
 	}
 
-	// build p.config
-	p.ProcessAnnotations()
+	// build p.config, from the config file set by RTPLUGS_CONFIG or else from the annotations
+	configFile := os.Getenv("RTPLUGS_CONFIG")
+	if configFile != "" {
+		// an invalid chain must not leave the service running without protection
+		if err := p.ProcessConfigFile(configFile); err != nil {
+			defaults.Logger.Fatalf("Failed to load plug config set by RTPLUGS_CONFIG, refusing to start: %s", err.Error())
+		}
+	} else {
+		p.ProcessAnnotations()
+	}
 
-	defaults.Ctx, p.rt = rtplugs.NewConfigrablePlugs(defaults.Ctx, defaults.Logger, servicename, defaults.Env.ServingNamespace, p.plugs, p.config) // add qOpts.Context
+	// the transport is wrapped even when no plug is activated, such that plugs
+	// activated later by a policy change protect the service without a pod restart
+	defaults.Ctx, p.rt = rtplugs.NewReconfigurablePlugs(defaults.Ctx, defaults.Logger, servicename, defaults.Env.ServingNamespace, p.plugs, p.config) // add qOpts.Context
 	if p.rt != nil {
+		if len(p.plugs) == 0 {
+			defaults.Logger.Infof("No plugs were activated, watching for a policy change")
+		}
 		defaults.Transport = p.rt.Transport(defaults.Transport)
+		if configFile != "" {
+			p.rt.WatchFile(configFile, annotationsPollInterval, rtplugs.ParseConfigFile)
+		} else {
+			// Kubernetes updates the annotations file when the pod annotations change
+			p.rt.WatchFile(annotationsFile, annotationsPollInterval, ParseAnnotations)
+		}
 	} else {
-		defaults.Logger.Infof("No plugs were activated")
+		defaults.Logger.Errorf("Failed to set up the plugs")
+	}
+
+	// Serve the admin endpoints on a separate port, e.g. RTPLUGS_ADMIN_ADDR=":9091"
+	if addr := os.Getenv("RTPLUGS_ADMIN_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/plugs", p.AdminHandler())
+		mux.Handle("/ready", p.ReadyHandler())
+		p.admin = &http.Server{Addr: addr, Handler: mux}
+		go func(admin *http.Server) {
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				defaults.Logger.Infof("Admin server at %s returned an error %s", addr, err.Error())
+			}
+		}(p.admin)
 	}
 }
 
+// AdminHandler() returns an http.Handler serving the state of the activated plugs as JSON
+func (p *QPSecurityPlugs) AdminHandler() http.Handler {
+	return p.rt.AdminHandler()
+}
+
+// Ready() returns an error when the activated plugs can't protect the service
+func (p *QPSecurityPlugs) Ready() error {
+	return p.rt.Ready()
+}
+
+// ReadyHandler() returns an http.Handler responding with 503 when the activated plugs are not ready
+//
+// sharedmain probes the user container directly, without a hook for extensions.
+// Point a readiness probe of the queue-proxy container to this handler, such that
+// Knative stops routing to a pod whose plugs can't protect the service.
+func (p *QPSecurityPlugs) ReadyHandler() http.Handler {
+	return p.rt.ReadyHandler()
+}
+
 func (p *QPSecurityPlugs) Shutdown() {
+	if p.admin != nil {
+		p.admin.Close()
+		p.admin = nil
+	}
 	if p.rt != nil {
 		p.rt.Close()
 	}
@@ -0,0 +1,32 @@
+package qpsecurity
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	data := []byte(`kubernetes.io/config.seen="2022-01-01T00:00:00Z"
+qpextention.knative.dev/rtgate-activate="Enable"
+qpextention.knative.dev/rtgate-config-Mode="Monitor"
+qpextention.knative.dev/rtgate-config-matchpath="/API/Upload,/Admin"
+qpextention.knative.dev/rtgate-config-skippath="/Healthz"
+qpextention.knative.dev/testgate-activate="disable"
+qpextention.knative.dev/testgate-config-sender="Someone"
+`)
+	plugs, config, err := ParseAnnotations(data)
+	if err != nil {
+		t.Fatalf("ParseAnnotations returned %v", err)
+	}
+	if !reflect.DeepEqual(plugs, []string{"rtgate"}) {
+		t.Errorf("ParseAnnotations returned plugs %v", plugs)
+	}
+	// the values of route keys keep their case, such that mixed case paths are matched
+	want := map[string]map[string]string{
+		"rtgate":   {"mode": "monitor", "matchpath": "/API/Upload,/Admin", "skippath": "/Healthz"},
+		"testgate": {"sender": "someone"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("ParseAnnotations returned config %v, want %v", config, want)
+	}
+}
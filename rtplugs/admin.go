@@ -0,0 +1,144 @@
+package rtplugs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The value replacing config values that may hold secrets
+const maskedValue = "******"
+
+// Config keys holding any of these words are masked by the admin handler
+var secretWords = []string{"secret", "password", "passwd", "token", "key", "credential"}
+
+// The state of the plug chain, as served by AdminHandler
+type adminStatus struct {
+	Service   string       `json:"service,omitempty"`
+	Namespace string       `json:"namespace,omitempty"`
+	Plugs     []plugStatus `json:"plugs"`
+}
+
+// The state of an active plug instance, as served by AdminHandler
+type plugStatus struct {
+	Name          string            `json:"name"`
+	Plug          string            `json:"plug"`
+	Version       string            `json:"version"`
+	Mode          string            `json:"mode"`
+	Priority      int               `json:"priority"`
+	Config        map[string]string `json:"config,omitempty"`
+	Approved      uint64            `json:"approved"`
+	Blocked       uint64            `json:"blocked"`
+	WouldBlock    uint64            `json:"wouldBlock"`
+	Skipped       uint64            `json:"skipped"`
+	Timeouts      uint64            `json:"timeouts"`
+	Panics        uint64            `json:"panics"`
+	InitError     string            `json:"initError,omitempty"`
+	HealthError   string            `json:"healthError,omitempty"`
+	LastError     string            `json:"lastError,omitempty"`
+	LastErrorTime *time.Time        `json:"lastErrorTime,omitempty"`
+}
+
+// AdminHandler() returns an http.Handler serving the state of the plug chain as JSON
+//
+// For each active plug instance, the handler lists the plug name and version,
+// its effective config - the last config the plug accepted, with values that may hold
+// secrets masked - the counters
+// of its decisions, the last error it reported and the result of its last health check.
+// Mount it on a separate admin port, as it is not meant for the clients of the service:
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/plugs", rt.AdminHandler())
+//	go http.ListenAndServe(":9091", mux)
+//
+// A nil RoundTrip (i.e. no plugs were activated) serves an empty list of plugs.
+func (rt *RoundTrip) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := json.MarshalIndent(rt.adminStatus(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	})
+}
+
+func (rt *RoundTrip) adminStatus() *adminStatus {
+	status := &adminStatus{Plugs: []plugStatus{}}
+	if rt == nil {
+		return status
+	}
+	status.Service = rt.serviceName
+	status.Namespace = rt.namespace
+	for _, ap := range rt.currentPlugs() {
+		status.Plugs = append(status.Plugs, ap.status())
+	}
+	return status
+}
+
+func (ap *activePlug) status() plugStatus {
+	ap.mu.RLock()
+	policy := ap.plugPolicy
+	config := maskConfig(ap.config)
+	lastErr := ap.lastErr
+	lastErrTime := ap.lastErrTime
+	health := ap.health
+	ap.mu.RUnlock()
+
+	s := plugStatus{
+		Name:       ap.name(),
+		Plug:       ap.plug.PlugName(),
+		Version:    ap.plug.PlugVersion(),
+		Mode:       "enforce",
+		Priority:   policy.priority,
+		Config:     config,
+		Approved:   atomic.LoadUint64(&ap.approved),
+		Blocked:    atomic.LoadUint64(&ap.blocked),
+		WouldBlock: atomic.LoadUint64(&ap.wouldBlock),
+		Skipped:    atomic.LoadUint64(&ap.skipped),
+		Timeouts:   atomic.LoadUint64(&ap.timeouts),
+		Panics:     atomic.LoadUint64(&ap.panics),
+	}
+	if policy.monitor {
+		s.Mode = "monitor"
+	}
+	if ap.initErr != nil {
+		s.InitError = ap.initErr.Error()
+	}
+	if health != nil {
+		s.HealthError = health.Error()
+	}
+	if lastErr != nil {
+		s.LastError = lastErr.Error()
+		s.LastErrorTime = &lastErrTime
+	}
+	return s
+}
+
+// maskConfig() returns a copy of config c with the values that may hold secrets masked
+func maskConfig(c map[string]string) map[string]string {
+	if c == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(c))
+	for k, v := range c {
+		masked[k] = v
+		lower := strings.ToLower(k)
+		for _, word := range secretWords {
+			if strings.Contains(lower, word) {
+				masked[k] = maskedValue
+				break
+			}
+		}
+	}
+	return masked
+}
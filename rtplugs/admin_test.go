@@ -0,0 +1,94 @@
+package rtplugs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getStatus(t *testing.T, rt *RoundTrip) *adminStatus {
+	w := httptest.NewRecorder()
+	rt.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/plugs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("AdminHandler returned status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("AdminHandler returned Content-Type %q", ct)
+	}
+	status := new(adminStatus)
+	if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+		t.Fatalf("AdminHandler returned illegal JSON: %v", err)
+	}
+	return status
+}
+
+func TestAdminHandler(t *testing.T) {
+	allow := newActivePlug(&fakePlug{name: "allow", version: "1.0.0"}, "allow", map[string]string{"apiKey": "s3cr3t", "answer": "42"})
+	block := newActivePlug(&fakePlug{name: "block", version: "2.0.0", reqErr: errors.New("fake error")}, "gate", map[string]string{"mode": "monitor"})
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{allow, block}}, serviceName: "myid", namespace: "myns"}
+	rt.Transport(new(FakeRoundTrip))
+	rt.RoundTrip(reqtest)
+
+	status := getStatus(t, rt)
+	if status.Service != "myid" || status.Namespace != "myns" || len(status.Plugs) != 2 {
+		t.Fatalf("AdminHandler returned %+v", status)
+	}
+	p := status.Plugs[0]
+	if p.Name != "allow" || p.Plug != "allow" || p.Version != "1.0.0" || p.Mode != "enforce" {
+		t.Errorf("AdminHandler returned plug %+v", p)
+	}
+	if p.Config["apiKey"] != maskedValue || p.Config["answer"] != "42" {
+		t.Errorf("AdminHandler returned config %v", p.Config)
+	}
+	if p.Approved != 2 || p.Blocked != 0 || p.LastError != "" {
+		t.Errorf("AdminHandler returned counters %+v", p)
+	}
+	p = status.Plugs[1]
+	if p.Name != "gate" || p.Plug != "block" || p.Mode != "monitor" {
+		t.Errorf("AdminHandler returned plug %+v", p)
+	}
+	if p.WouldBlock != 1 || p.Approved != 1 || p.LastError != "fake error" || p.LastErrorTime == nil {
+		t.Errorf("AdminHandler returned counters %+v", p)
+	}
+	if allow.config["apiKey"] != "s3cr3t" {
+		t.Errorf("AdminHandler modified the plug config")
+	}
+
+	// no plugs
+	var none *RoundTrip
+	if status := getStatus(t, none); status.Plugs == nil || len(status.Plugs) != 0 {
+		t.Errorf("AdminHandler of a nil RoundTrip returned %+v", status)
+	}
+
+	w := httptest.NewRecorder()
+	rt.AdminHandler().ServeHTTP(w, httptest.NewRequest("POST", "/plugs", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("AdminHandler accepted a POST with status %d", w.Code)
+	}
+}
+
+func TestAdminHandlerConfig(t *testing.T) {
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"restartplug:gate"}, map[string]map[string]string{"gate": {"rules": "one"}})
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil")
+	}
+	defer rt.Close()
+
+	// a config the plug failed to accept is not reported
+	if err := rt.Reconfigure(map[string]map[string]string{"gate": {"rules": "two", "fail": "yes"}}); err == nil {
+		t.Errorf("Reconfigure of a plug failing to initialize returned nil")
+	}
+	if c := getStatus(t, rt).Plugs[0].Config; c["rules"] != "one" || c["fail"] != "" {
+		t.Errorf("AdminHandler returned config %v after a failed reconfigure", c)
+	}
+
+	if err := rt.Reconfigure(map[string]map[string]string{"gate": {"rules": "two"}}); err != nil {
+		t.Errorf("Reconfigure returned %v", err)
+	}
+	if c := getStatus(t, rt).Plugs[0].Config; c["rules"] != "two" {
+		t.Errorf("AdminHandler returned config %v after a reconfigure", c)
+	}
+}
@@ -0,0 +1,263 @@
+package rtplugs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// A chain of active plugs approving requests in order and responses in reverse order
+//
+// The plugs are sorted by priority, lowest first (see sortPlugs).
+// A chain is never modified once in use. Adding or removing plugs replaces the
+// chain as a whole, while requests in flight keep using the chain they started with.
+type chain struct {
+	plugs    []*activePlug
+	inflight sync.WaitGroup // requests using the chain
+}
+
+// acquire() returns the current chain, whose plugs are not shut down before release() is called
+func (rt *RoundTrip) acquire() *chain {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	rt.chain.inflight.Add(1)
+	return rt.chain
+}
+
+func (c *chain) release() {
+	c.inflight.Done()
+}
+
+// match() returns the plugs of the chain whose route matches req, in chain order
+func (c *chain) match(req *http.Request) []*activePlug {
+	var matched []*activePlug
+	for i, ap := range c.plugs {
+		if ap.policy().route.matches(req) {
+			if matched != nil {
+				matched = append(matched, ap)
+			}
+			continue
+		}
+		pi.Log.Debugf("rtplugs Plug %s: skipping request to %s %s outside of the plug route", ap.name(), req.Host, req.URL.Path)
+		if matched == nil {
+			matched = make([]*activePlug, i, len(c.plugs))
+			copy(matched, c.plugs[:i])
+		}
+	}
+	if matched == nil {
+		// the common case, all plugs approve the request
+		return c.plugs
+	}
+	return matched
+}
+
+// currentPlugs() returns the plugs of the current chain
+func (rt *RoundTrip) currentPlugs() []*activePlug {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.chain.plugs
+}
+
+// replaceChain() swaps the current chain with a new chain of plugs, sorted by priority
+//
+// Plugs of the old chain missing from the new chain are shut down in the
+// background once all requests using the old chain complete.
+func (rt *RoundTrip) replaceChain(plugs []*activePlug) {
+	sortPlugs(plugs)
+	rt.mu.Lock()
+	old := rt.chain
+	rt.chain = &chain{plugs: plugs}
+	rt.mu.Unlock()
+	rt.startHealthChecks(plugs)
+
+	var removed []*activePlug
+	for _, ap := range old.plugs {
+		if findPlug(plugs, ap.name()) != ap {
+			removed = append(removed, ap)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	rt.retiring.Add(1)
+	go func() {
+		defer rt.retiring.Done()
+		old.inflight.Wait()
+		for _, ap := range removed {
+			pi.Log.Infof("rtplugs Plug %s: deactivated", ap.name())
+			ap.shutdown()
+		}
+	}()
+}
+
+// activatePlug() creates and initializes a new instance of a plug given its entry in the plug list
+//
+// A plug failing to initialize is returned with its initErr set, unless its policy is to skip the plug
+func (rt *RoundTrip) activatePlug(ctx context.Context, plugEntry string, c map[string]string) (context.Context, *activePlug, error) {
+	plugName, instanceName := parsePlugEntry(plugEntry)
+	newPlug, foundPlug := pi.RoundTripPlugs[plugName]
+	if !foundPlug {
+		return ctx, nil, fmt.Errorf("plug %s is not supported by this image. Consult your IT", plugName)
+	}
+	p, err := createPlug(newPlug)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	// found a loaded plug, lets activate a new instance of it
+	pi.Log.Infof("Activating Plug %s with config %v", instanceName, c)
+	ap := newActivePlug(p, instanceName, c)
+	ctxOut, err := ap.init(ctx, c, rt.serviceName, rt.namespace, rt.logger)
+	if err != nil {
+		if ap.skipOnFailure(err) {
+			return ctx, nil, err
+		}
+		pi.Log.Warnf("rtplugs Plug %s: %v, the plug will block all requests", instanceName, err)
+		ap.initErr = err
+	}
+	pi.Log.Debugf("Plug %s (%s) version %s is active for service %s namespace %s", ap.name(), ap.plug.PlugName(), ap.plug.PlugVersion(), rt.serviceName, rt.namespace)
+	return ctxOut, ap, nil
+}
+
+// reconfigurePlug() applies config c to an active plug, returning the plug instance to keep in the chain
+//
+// Plugs implementing pluginterfaces.Reconfigurable, and plugs whose config changed
+// only in the keys reserved by rtplugs, are reconfigured in place. Other plugs are
+// replaced by a new instance initialized with c - the old instance keeps serving the
+// requests in flight and is shut down by replaceChain once they complete.
+// A plug failing to reconfigure is returned as is, keeping its old config and policy.
+func (rt *RoundTrip) reconfigurePlug(ap *activePlug, c map[string]string) (*activePlug, error) {
+	if _, ok := ap.plug.(pi.Reconfigurable); ok || !ap.plugConfigChanged(c) {
+		return ap, ap.reconfigure(c)
+	}
+	newPlug, foundPlug := pi.RoundTripPlugs[ap.plug.PlugName()]
+	if !foundPlug {
+		return ap, fmt.Errorf("plug %s is not registered, can't activate it with a new config", ap.plug.PlugName())
+	}
+	p, err := createPlug(newPlug)
+	if err != nil {
+		return ap, err
+	}
+	next := newActivePlug(p, ap.instance, c)
+	if _, err := next.init(rt.ctx, c, rt.serviceName, rt.namespace, rt.logger); err != nil {
+		return ap, err
+	}
+	pi.Log.Infof("rtplugs Plug %s: the plug does not support Reconfigure, activated a new instance with config %v", ap.name(), c)
+	return next, nil
+}
+
+// SetPlugs() replaces the active plugs with the plugs in the plug list
+//
+// The plug list and config c are as in NewConfigrablePlugs.
+// Plug instances remaining in the list are reconfigured using c, as in Reconfigure.
+// New plug instances are activated. Removed plug instances are shut down once
+// all requests in flight using them complete.
+func (rt *RoundTrip) SetPlugs(plugs []string, c map[string]map[string]string) error {
+	rt.updateMu.Lock()
+	defer rt.updateMu.Unlock()
+
+	current := rt.currentPlugs()
+	var next []*activePlug
+	var failed []string
+	for _, plugEntry := range plugs {
+		plugName, instanceName := parsePlugEntry(plugEntry)
+		if findPlug(next, instanceName) != nil {
+			pi.Log.Warnf("rtplugs Plug %s is already active, use an alias to activate it again", instanceName)
+			continue
+		}
+		if ap := findPlug(current, instanceName); ap != nil && ap.plug.PlugName() == plugName {
+			ap, err := rt.reconfigurePlug(ap, c[instanceName])
+			if err != nil {
+				pi.Log.Warnf("rtplugs Plug %s: failed to reconfigure: %v", instanceName, err)
+				failed = append(failed, instanceName)
+			}
+			next = append(next, ap)
+			continue
+		}
+		_, ap, err := rt.activatePlug(rt.ctx, plugEntry, c[instanceName])
+		if err != nil {
+			pi.Log.Warnf("rtplugs Plug %s: %v, skipping plug", instanceName, err)
+			failed = append(failed, instanceName)
+			continue
+		}
+		next = append(next, ap)
+	}
+	rt.replaceChain(next)
+	if len(failed) > 0 {
+		return fmt.Errorf("rtplugs failed to set plugs %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// AddPlug() activates a new plug instance, placed in the chain by its priority
+//
+// plugEntry is an entry of the plug list, such as "rtgate" or "rtgate:gate1",
+// and c is the config of the new plug instance.
+func (rt *RoundTrip) AddPlug(plugEntry string, c map[string]string) error {
+	rt.updateMu.Lock()
+	defer rt.updateMu.Unlock()
+
+	_, instanceName := parsePlugEntry(plugEntry)
+	current := rt.currentPlugs()
+	if findPlug(current, instanceName) != nil {
+		return fmt.Errorf("rtplugs Plug %s is already active, use an alias to activate it again", instanceName)
+	}
+	_, ap, err := rt.activatePlug(rt.ctx, plugEntry, c)
+	if err != nil {
+		return fmt.Errorf("rtplugs Plug %s: %w", instanceName, err)
+	}
+	next := make([]*activePlug, len(current), len(current)+1)
+	copy(next, current)
+	rt.replaceChain(append(next, ap))
+	return nil
+}
+
+// RemovePlug() removes the plug instance named instanceName from the chain
+//
+// The plug instance is shut down once all requests in flight using it complete.
+func (rt *RoundTrip) RemovePlug(instanceName string) error {
+	rt.updateMu.Lock()
+	defer rt.updateMu.Unlock()
+
+	current := rt.currentPlugs()
+	if findPlug(current, instanceName) == nil {
+		return fmt.Errorf("rtplugs Plug %s is not active", instanceName)
+	}
+	var next []*activePlug
+	for _, ap := range current {
+		if ap.name() != instanceName {
+			next = append(next, ap)
+		}
+	}
+	rt.replaceChain(next)
+	return nil
+}
+
+// sortPlugs() sorts plugs by priority, keeping the order of plugs of the same priority
+func sortPlugs(plugs []*activePlug) {
+	sort.SliceStable(plugs, func(i, j int) bool {
+		return plugs[i].policy().priority < plugs[j].policy().priority
+	})
+}
+
+// plugsSorted() reports whether plugs are sorted by priority
+func plugsSorted(plugs []*activePlug) bool {
+	return sort.SliceIsSorted(plugs, func(i, j int) bool {
+		return plugs[i].policy().priority < plugs[j].policy().priority
+	})
+}
+
+// findPlug() returns the plug instance named instanceName or nil
+func findPlug(plugs []*activePlug, instanceName string) *activePlug {
+	for _, ap := range plugs {
+		if ap.name() == instanceName {
+			return ap
+		}
+	}
+	return nil
+}
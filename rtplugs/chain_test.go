@@ -0,0 +1,215 @@
+package rtplugs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// shutdownPlug counts the instances shut down
+type shutdownPlug struct {
+	fakePlug
+}
+
+var shutdowns uint64
+
+func (p *shutdownPlug) Shutdown() {
+	atomic.AddUint64(&shutdowns, 1)
+}
+
+// orderPlug records the order of approve calls in calls
+type orderPlug struct {
+	fakePlug
+	priority int
+	calls    *[]string
+	mu       *sync.Mutex
+}
+
+func (p *orderPlug) PlugPriority() int {
+	return p.priority
+}
+
+func (p *orderPlug) record(phase string) {
+	p.mu.Lock()
+	*p.calls = append(*p.calls, phase+":"+p.name)
+	p.mu.Unlock()
+}
+
+func (p *orderPlug) ApproveRequest(req *http.Request) (*http.Request, error) {
+	p.record("req")
+	return req, nil
+}
+
+func (p *orderPlug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	p.record("resp")
+	return resp, nil
+}
+
+func init() {
+	pi.RegisterPlug(func() pi.RoundTripPlug {
+		return &shutdownPlug{fakePlug{name: "shutdownplug", version: "0.0.1"}}
+	})
+	pi.RegisterPlug(func() pi.RoundTripPlug {
+		return &orderPlug{fakePlug: fakePlug{name: "authplug", version: "0.0.1"}, priority: -100}
+	})
+}
+
+func instanceNames(rt *RoundTrip) (names []string) {
+	for _, ap := range rt.currentPlugs() {
+		names = append(names, ap.name())
+	}
+	return
+}
+
+func TestSetPlugs(t *testing.T) {
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"testgate:first"}, nil)
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil\n")
+	}
+	defer rt.Close()
+	first := rt.currentPlugs()[0]
+
+	c := map[string]map[string]string{"first": {"mode": "monitor"}}
+	if err := rt.SetPlugs([]string{"testgate:first", "testgate:second", "noplug"}, c); err == nil {
+		t.Errorf("SetPlugs with an unknown plug should fail\n")
+	}
+	if names := instanceNames(rt); len(names) != 2 || names[0] != "first" || names[1] != "second" {
+		t.Fatalf("SetPlugs activated %v\n", names)
+	}
+	if rt.currentPlugs()[0] != first {
+		t.Errorf("SetPlugs replaced a plug remaining in the list\n")
+	}
+	if !first.policy().monitor {
+		t.Errorf("SetPlugs did not reconfigure a plug remaining in the list\n")
+	}
+
+	if err := rt.SetPlugs([]string{"testgate:second"}, nil); err != nil {
+		t.Errorf("SetPlugs returned %v\n", err)
+	}
+	if names := instanceNames(rt); len(names) != 1 || names[0] != "second" {
+		t.Errorf("SetPlugs left %v\n", names)
+	}
+}
+
+func TestAddRemovePlug(t *testing.T) {
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"testgate"}, nil)
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil\n")
+	}
+	rt.Transport(new(FakeRoundTrip))
+
+	if err := rt.AddPlug("testgate", nil); err == nil {
+		t.Errorf("AddPlug of an active instance should fail\n")
+	}
+	if err := rt.AddPlug("noplug", nil); err == nil {
+		t.Errorf("AddPlug of an unknown plug should fail\n")
+	}
+	if err := rt.RemovePlug("nothing"); err == nil {
+		t.Errorf("RemovePlug of an inactive instance should fail\n")
+	}
+	if err := rt.AddPlug("shutdownplug:counted", map[string]string{"mode": "monitor"}); err != nil {
+		t.Fatalf("AddPlug returned %v\n", err)
+	}
+	if names := instanceNames(rt); len(names) != 2 || names[1] != "counted" {
+		t.Fatalf("AddPlug activated %v\n", names)
+	}
+
+	// a removed plug is shut down once the requests in flight complete
+	before := atomic.LoadUint64(&shutdowns)
+	inflight := rt.acquire()
+	if err := rt.RemovePlug("counted"); err != nil {
+		t.Fatalf("RemovePlug returned %v\n", err)
+	}
+	if names := instanceNames(rt); len(names) != 1 || names[0] != "testgate" {
+		t.Errorf("RemovePlug left %v\n", names)
+	}
+	if _, err := rt.RoundTrip(reqtest); err != nil {
+		t.Errorf("RoundTrip returned %v while draining\n", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadUint64(&shutdowns) != before {
+		t.Errorf("plug was shut down while a request was in flight\n")
+	}
+	inflight.release()
+	rt.retiring.Wait()
+	if atomic.LoadUint64(&shutdowns) != before+1 {
+		t.Errorf("plug was not shut down after the requests in flight completed\n")
+	}
+
+	// Close shuts down the remaining plugs
+	if err := rt.AddPlug("shutdownplug:counted", nil); err != nil {
+		t.Fatalf("AddPlug returned %v\n", err)
+	}
+	rt.Close()
+	if atomic.LoadUint64(&shutdowns) != before+2 {
+		t.Errorf("Close did not shut down the plugs\n")
+	}
+	if len(rt.currentPlugs()) != 0 {
+		t.Errorf("Close left active plugs\n")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	var calls []string
+	var mu sync.Mutex
+	newPlug := func(name string, priority int, c map[string]string) *activePlug {
+		return newActivePlug(&orderPlug{fakePlug: fakePlug{name: name}, priority: priority, calls: &calls, mu: &mu}, name, c)
+	}
+	plugs := []*activePlug{
+		newPlug("inspect", 100, nil),
+		newPlug("ratelimit", 0, nil),
+		newPlug("audit", 100, nil),
+		newPlug("auth", 100, map[string]string{"priority": "-100"}),
+	}
+	rt := &RoundTrip{chain: &chain{}}
+	rt.replaceChain(plugs)
+	if names := instanceNames(rt); !reflect.DeepEqual(names, []string{"auth", "ratelimit", "inspect", "audit"}) {
+		t.Errorf("chain ordered as %v", names)
+	}
+
+	rt.next = &FakeRoundTrip{}
+	req := httptest.NewRequest("GET", "/", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip returned %v", err)
+	}
+	want := []string{
+		"req:auth", "req:ratelimit", "req:inspect", "req:audit",
+		"resp:audit", "resp:inspect", "resp:ratelimit", "resp:auth",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("plugs were called in order %v", calls)
+	}
+
+	// reconfiguring the priority reorders the chain
+	c := map[string]map[string]string{"auth": {"priority": "-100"}, "audit": {"priority": "50"}}
+	if err := rt.Reconfigure(c); err != nil {
+		t.Errorf("Reconfigure returned %v", err)
+	}
+	if names := instanceNames(rt); !reflect.DeepEqual(names, []string{"auth", "ratelimit", "audit", "inspect"}) {
+		t.Errorf("chain reordered as %v", names)
+	}
+	rt.Close()
+
+	// the priority declared by the plug applies regardless of the plug list order
+	_, rt = NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"testgate", "authplug"}, nil)
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil\n")
+	}
+	defer rt.Close()
+	if names := instanceNames(rt); !reflect.DeepEqual(names, []string{"authplug", "testgate"}) {
+		t.Errorf("NewConfigrablePlugs ordered the chain as %v", names)
+	}
+	if err := rt.AddPlug("authplug:late", map[string]string{"priority": "-200"}); err != nil {
+		t.Errorf("AddPlug returned %v", err)
+	}
+	if names := instanceNames(rt); !reflect.DeepEqual(names, []string{"late", "authplug", "testgate"}) {
+		t.Errorf("AddPlug ordered the chain as %v", names)
+	}
+}
@@ -0,0 +1,205 @@
+package rtplugs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// How often the file set by env RTPLUGS_CONFIG is checked for changes
+const configPollInterval = 10 * time.Second
+
+// A ChainConfig is a plug chain, as set in a YAML or JSON config file
+//
+// For example:
+//
+//	plugs:
+//	- name: rtgate
+//	  alias: gate1
+//	  mode: monitor
+//	  onFailure: open
+//	  timeout: 100ms
+//	  priority: -10
+//	  route:
+//	    paths: [/api/upload]
+//	    methods: [POST, PUT]
+//	  config:
+//	    sender: someone
+//	- name: testgate
+type ChainConfig struct {
+	Plugs []PlugConfig `json:"plugs"`
+}
+
+// A PlugConfig is a plug instance in a plug chain
+type PlugConfig struct {
+	Name      string            `json:"name"`                // the plug name
+	Alias     string            `json:"alias,omitempty"`     // the instance name, defaults to the plug name
+	Mode      string            `json:"mode,omitempty"`      // "monitor" or "enforce" (default)
+	OnFailure string            `json:"onFailure,omitempty"` // "open" or "closed" (default)
+	OnTimeout string            `json:"onTimeout,omitempty"` // "open" or "closed", defaults to OnFailure
+	Timeout   string            `json:"timeout,omitempty"`   // a duration such as "100ms", defaults to no timeout
+	Priority  *int              `json:"priority,omitempty"`  // overrides the priority declared by the plug, lower runs first
+	Route     *RouteConfig      `json:"route,omitempty"`     // the requests approved by the plug, defaults to all requests
+	Config    map[string]string `json:"config,omitempty"`    // the config passed to the plug
+}
+
+// A RouteConfig scopes a plug to the requests matching all fields set
+type RouteConfig struct {
+	Paths     []string `json:"paths,omitempty"`     // path prefixes (e.g. "/api/upload") or globs (e.g. "/api/*/upload"), any of which must match
+	Hosts     []string `json:"hosts,omitempty"`     // hosts or host globs (e.g. "*.example.com"), any of which must match
+	Methods   []string `json:"methods,omitempty"`   // methods, any of which must match
+	Headers   []string `json:"headers,omitempty"`   // header names, any of which must be present
+	SkipPaths []string `json:"skipPaths,omitempty"` // path prefixes or globs of requests the plug never sees (e.g. "/healthz")
+}
+
+// LoadChainConfig(path) reads and validates a plug chain config file
+func LoadChainConfig(path string) (*ChainConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := ParseChainConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cc, nil
+}
+
+// ParseChainConfig(data) parses and validates a plug chain config in YAML or JSON
+//
+// Unknown fields are rejected, as they are likely typos.
+func ParseChainConfig(data []byte) (*ChainConfig, error) {
+	cc := new(ChainConfig)
+	if err := yaml.UnmarshalStrict(data, cc); err != nil {
+		return nil, err
+	}
+	if err := cc.Validate(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// ParseConfigFile() is a ConfigParser of plug chain config files, for use with WatchFile
+func ParseConfigFile(data []byte) (plugs []string, c map[string]map[string]string, err error) {
+	cc, err := ParseChainConfig(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	plugs, c = cc.PlugsAndConfig()
+	return
+}
+
+// Validate() returns an error describing the first problem found in the plug chain
+func (cc *ChainConfig) Validate() error {
+	if len(cc.Plugs) == 0 {
+		// an empty file would silently deactivate all plugs
+		return errors.New("no plugs listed")
+	}
+	instances := make(map[string]bool)
+	for i, pc := range cc.Plugs {
+		if pc.Name == "" {
+			return fmt.Errorf("plugs[%d]: missing name", i)
+		}
+		if strings.ContainsAny(pc.Name, ":, ") || strings.ContainsAny(pc.Alias, ":, ") {
+			return fmt.Errorf("plugs[%d]: name and alias may not contain ':', ',' or spaces", i)
+		}
+		instance := pc.instanceName()
+		if instances[instance] {
+			return fmt.Errorf("plugs[%d]: plug %s is listed twice, use an alias to activate it again", i, instance)
+		}
+		instances[instance] = true
+
+		switch pc.Mode {
+		case "", "enforce", "monitor":
+		default:
+			return fmt.Errorf("plugs[%d]: illegal mode %q, use monitor or enforce", i, pc.Mode)
+		}
+		for field, v := range map[string]string{"onFailure": pc.OnFailure, "onTimeout": pc.OnTimeout} {
+			switch v {
+			case "", "open", "closed":
+			default:
+				return fmt.Errorf("plugs[%d]: illegal %s %q, use open or closed", i, field, v)
+			}
+		}
+		if pc.Timeout != "" {
+			if timeout, err := time.ParseDuration(pc.Timeout); err != nil || timeout < 0 {
+				return fmt.Errorf("plugs[%d]: illegal timeout %q, use a duration such as 100ms", i, pc.Timeout)
+			}
+		}
+		if err := pc.Route.validate(); err != nil {
+			return fmt.Errorf("plugs[%d]: route: %w", i, err)
+		}
+		for _, key := range reservedKeys {
+			if _, ok := pc.Config[key]; ok {
+				return fmt.Errorf("plugs[%d]: config key %q is reserved, set it as a field of the plug", i, key)
+			}
+		}
+	}
+	return nil
+}
+
+// PlugsAndConfig() returns the plug list and the config of each plug instance, as accepted by NewConfigrablePlugs
+//
+// The mode, failure policy, timeout, priority and route of each plug are set using the config keys reserved by rtplugs.
+func (cc *ChainConfig) PlugsAndConfig() (plugs []string, c map[string]map[string]string) {
+	c = make(map[string]map[string]string)
+	for _, pc := range cc.Plugs {
+		entry := pc.Name
+		if pc.Alias != "" {
+			entry += ":" + pc.Alias
+		}
+		plugs = append(plugs, entry)
+
+		plugConfig := make(map[string]string, len(pc.Config)+4)
+		for k, v := range pc.Config {
+			plugConfig[k] = v
+		}
+		for key, v := range map[string]string{modeKey: pc.Mode, onFailureKey: pc.OnFailure, onTimeoutKey: pc.OnTimeout, timeoutKey: pc.Timeout} {
+			if v != "" {
+				plugConfig[key] = v
+			}
+		}
+		if pc.Priority != nil {
+			plugConfig[priorityKey] = strconv.Itoa(*pc.Priority)
+		}
+		if r := pc.Route; r != nil {
+			for key, list := range map[string][]string{matchPathKey: r.Paths, matchHostKey: r.Hosts, matchMethodKey: r.Methods, matchHeaderKey: r.Headers, skipPathKey: r.SkipPaths} {
+				if len(list) > 0 {
+					plugConfig[key] = strings.Join(list, ",")
+				}
+			}
+		}
+		c[pc.instanceName()] = plugConfig
+	}
+	return
+}
+
+func (r *RouteConfig) validate() error {
+	if r == nil {
+		return nil
+	}
+	for field, list := range map[string][]string{"paths": r.Paths, "hosts": r.Hosts, "methods": r.Methods, "headers": r.Headers, "skipPaths": r.SkipPaths} {
+		for _, entry := range list {
+			if strings.TrimSpace(entry) == "" || strings.Contains(entry, ",") {
+				return fmt.Errorf("illegal %s entry %q", field, entry)
+			}
+			if _, err := path.Match(entry, ""); err != nil {
+				return fmt.Errorf("illegal %s pattern %q", field, entry)
+			}
+		}
+	}
+	return nil
+}
+
+func (pc *PlugConfig) instanceName() string {
+	if pc.Alias != "" {
+		return pc.Alias
+	}
+	return pc.Name
+}
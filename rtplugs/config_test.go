@@ -0,0 +1,129 @@
+package rtplugs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const chainYAML = `
+plugs:
+- name: testgate
+  alias: gate1
+  mode: monitor
+  onFailure: open
+  timeout: 100ms
+  priority: -10
+  route:
+    paths: [/api/upload, /api/*/files]
+    skipPaths: [/healthz]
+  config:
+    sender: someone
+    retries: 3
+- name: testgate
+`
+
+func TestParseChainConfig(t *testing.T) {
+	cc, err := ParseChainConfig([]byte(chainYAML))
+	if err != nil {
+		t.Fatalf("ParseChainConfig returned %v", err)
+	}
+	plugs, c := cc.PlugsAndConfig()
+	if !reflect.DeepEqual(plugs, []string{"testgate:gate1", "testgate"}) {
+		t.Errorf("PlugsAndConfig returned plugs %v", plugs)
+	}
+	want := map[string]map[string]string{
+		"gate1": {"sender": "someone", "retries": "3", "mode": "monitor", "onfailure": "open", "timeout": "100ms", "priority": "-10",
+			"matchpath": "/api/upload,/api/*/files", "skippath": "/healthz"},
+		"testgate": {},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("PlugsAndConfig returned config %v", c)
+	}
+
+	// JSON is YAML too
+	if _, err := ParseChainConfig([]byte(`{"plugs": [{"name": "testgate", "onTimeout": "closed"}]}`)); err != nil {
+		t.Errorf("ParseChainConfig of JSON returned %v", err)
+	}
+}
+
+func TestParseChainConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unknown field", "plugs:\n- name: testgate\n  mod: monitor\n", "mod"},
+		{"missing name", "plugs:\n- alias: gate1\n", "missing name"},
+		{"illegal name", "plugs:\n- name: testgate:gate1\n", "may not contain"},
+		{"duplicate", "plugs:\n- name: testgate\n- name: testgate\n", "listed twice"},
+		{"duplicate alias", "plugs:\n- name: testgate\n  alias: gate\n- name: rtgate\n  alias: gate\n", "listed twice"},
+		{"mode", "plugs:\n- name: testgate\n  mode: audit\n", "illegal mode"},
+		{"onFailure", "plugs:\n- name: testgate\n  onFailure: ignore\n", "illegal onFailure"},
+		{"onTimeout", "plugs:\n- name: testgate\n  onTimeout: skip\n", "illegal onTimeout"},
+		{"timeout", "plugs:\n- name: testgate\n  timeout: 100\n", "illegal timeout"},
+		{"negative timeout", "plugs:\n- name: testgate\n  timeout: -1s\n", "illegal timeout"},
+		{"reserved key", "plugs:\n- name: testgate\n  config:\n    mode: monitor\n", "reserved"},
+		{"reserved route key", "plugs:\n- name: testgate\n  config:\n    matchpath: /api\n", "reserved"},
+		{"route pattern", "plugs:\n- name: testgate\n  route:\n    paths: ['/api/[']\n", "illegal paths pattern"},
+		{"route entry", "plugs:\n- name: testgate\n  route:\n    methods: ['GET,PUT']\n", "illegal methods entry"},
+		{"route field", "plugs:\n- name: testgate\n  route:\n    path: [/api]\n", "path"},
+		{"not yaml", "plugs: [", "yaml"},
+		{"empty", "", "no plugs"},
+		{"no plugs", "plugs: []\n", "no plugs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseChainConfig([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseChainConfig returned %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWithConfigFile(t *testing.T) {
+	InitializeEnv()
+	defer InitializeEnv()
+	defer os.Unsetenv("RTPLUGS_CONFIG")
+
+	path := filepath.Join(t.TempDir(), "plugs.yaml")
+	os.Setenv("RTPLUGS_CONFIG", path)
+	if rt, err := NewWithOptions(); rt != nil || err == nil {
+		t.Errorf("NewWithOptions with a missing config file returned %v, %v", rt, err)
+	}
+
+	if err := os.WriteFile(path, []byte(chainYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewWithOptions()
+	if rt == nil || err != nil {
+		t.Fatalf("NewWithOptions returned %v, %v", rt, err)
+	}
+	if names := instanceNames(rt); !reflect.DeepEqual(names, []string{"gate1", "testgate"}) {
+		t.Errorf("NewWithOptions activated %v", names)
+	}
+	if p := rt.currentPlugs()[0].policy(); !p.monitor || !p.failOpen {
+		t.Errorf("NewWithOptions set policy %+v", p)
+	}
+	rt.Close()
+
+	// options take precedence over the config file
+	rt, err = NewWithOptions(WithPlugs("testgate"))
+	if rt == nil || err != nil {
+		t.Fatalf("NewWithOptions returned %v, %v", rt, err)
+	}
+	if names := instanceNames(rt); !reflect.DeepEqual(names, []string{"testgate"}) {
+		t.Errorf("NewWithOptions WithPlugs activated %v", names)
+	}
+	rt.Close()
+
+	if err := os.WriteFile(path, []byte("plugs:\n- name: testgate\n  mode: audit\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rt, err := NewWithOptions(); rt != nil || err == nil {
+		t.Errorf("NewWithOptions with an illegal config file returned %v, %v", rt, err)
+	}
+}
@@ -0,0 +1,205 @@
+package rtplugs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// A sink writing each decision as a line of JSON
+type jsonLinesSink struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer // nil when the writer is not owned by the sink
+	closed bool
+}
+
+// NewJSONLinesSink(w) creates a sink writing each decision as a line of JSON to w
+func NewJSONLinesSink(w io.Writer) pi.DecisionSink {
+	return &jsonLinesSink{enc: json.NewEncoder(w)}
+}
+
+// NewStdoutSink() creates a sink writing each decision as a line of JSON to stdout
+func NewStdoutSink() pi.DecisionSink {
+	return NewJSONLinesSink(os.Stdout)
+}
+
+// NewFileSink(path) creates a sink appending each decision as a line of JSON to the file at path
+func NewFileSink(path string) (pi.DecisionSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLinesSink{enc: json.NewEncoder(f), closer: f}, nil
+}
+
+func (s *jsonLinesSink) Emit(d *pi.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		// emitted while the sink was being replaced
+		return
+	}
+	if err := s.enc.Encode(d); err != nil {
+		pi.Log.Warnf("rtplugs failed to write decision: %v", err)
+	}
+}
+
+func (s *jsonLinesSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// A sink posting each decision as JSON to an HTTP webhook
+//
+// Decisions are queued and posted in the background such that Emit never blocks.
+// Decisions arriving while the queue is full are dropped.
+type webhookSink struct {
+	url     string
+	client  *http.Client
+	mu      sync.RWMutex
+	closed  bool
+	events  chan *pi.Decision
+	done    chan struct{}
+	dropped uint64 // number of decisions dropped, updated atomically
+}
+
+// NewWebhookSink(url) creates a sink posting each decision as JSON to url
+func NewWebhookSink(url string) pi.DecisionSink {
+	s := &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		events: make(chan *pi.Decision, 1024),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for d := range s.events {
+			s.post(d)
+		}
+		close(s.done)
+	}()
+	return s
+}
+
+func (s *webhookSink) Emit(d *pi.Decision) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- d:
+	default:
+		if atomic.AddUint64(&s.dropped, 1) == 1 {
+			pi.Log.Warnf("rtplugs webhook %s is too slow, dropping decisions", s.url)
+		}
+	}
+}
+
+func (s *webhookSink) post(d *pi.Decision) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		pi.Log.Warnf("rtplugs failed to marshal decision: %v", err)
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		pi.Log.Warnf("rtplugs webhook %s returned an error %v", s.url, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		pi.Log.Warnf("rtplugs webhook %s returned status %d", s.url, resp.StatusCode)
+	}
+}
+
+// Close() stops accepting decisions and waits until all queued decisions are posted
+func (s *webhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+// A sink forwarding each decision to a list of sinks
+type multiSink struct {
+	sinks []pi.DecisionSink
+}
+
+// NewMultiSink(sinks...) creates a sink forwarding each decision to all sinks
+func NewMultiSink(sinks ...pi.DecisionSink) pi.DecisionSink {
+	return &multiSink{sinks: sinks}
+}
+
+func (s *multiSink) Emit(d *pi.Decision) {
+	for _, sink := range s.sinks {
+		sink.Emit(d)
+	}
+}
+
+func (s *multiSink) Close() (err error) {
+	for _, sink := range s.sinks {
+		if e := sink.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// NewDecisionSinks(spec) creates a sink from a comma seperated list of sinks
+//
+// Each sink in the list is one of:
+//
+//	stdout
+//	file:<path>
+//	http://<url> or https://<url>
+func NewDecisionSinks(spec string) (pi.DecisionSink, error) {
+	var sinks []pi.DecisionSink
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "stdout":
+			sinks = append(sinks, NewStdoutSink())
+		case strings.HasPrefix(entry, "file:"):
+			sink, err := NewFileSink(strings.TrimPrefix(entry, "file:"))
+			if err != nil {
+				NewMultiSink(sinks...).Close()
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case strings.HasPrefix(entry, "http://"), strings.HasPrefix(entry, "https://"):
+			sinks = append(sinks, NewWebhookSink(entry))
+		default:
+			NewMultiSink(sinks...).Close()
+			return nil, fmt.Errorf("unknown decision sink %q", entry)
+		}
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return NewMultiSink(sinks...), nil
+}
@@ -0,0 +1,209 @@
+package rtplugs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+type collectSink struct {
+	mu        sync.Mutex
+	decisions []*pi.Decision
+	closed    bool
+}
+
+func (s *collectSink) Emit(d *pi.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decisions = append(s.decisions, d)
+}
+
+func (s *collectSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestRoundTripDecisions(t *testing.T) {
+	sink := new(collectSink)
+	pi.SetDecisionSink(sink)
+	defer pi.SetDecisionSink(nil)
+
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/some/path", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	// responses are approved in reverse order
+	rt := &RoundTrip{
+		chain: &chain{plugs: []*activePlug{
+			{plug: &fakePlug{name: "block", respErr: &pi.BlockError{}}},
+			{plug: &fakePlug{name: "monitor", respErr: errors.New("fake error")}, plugPolicy: plugPolicy{monitor: true}},
+			{plug: &fakePlug{name: "allow"}},
+		}},
+		serviceName: "myid",
+		namespace:   "myns",
+	}
+	rt.Transport(new(FakeRoundTrip))
+	rt.RoundTrip(req)
+
+	want := []struct{ plug, phase, verdict string }{
+		{"block", pi.PhaseRequest, pi.VerdictAllow},
+		{"monitor", pi.PhaseRequest, pi.VerdictAllow},
+		{"allow", pi.PhaseRequest, pi.VerdictAllow},
+		{"allow", pi.PhaseResponse, pi.VerdictAllow},
+		{"monitor", pi.PhaseResponse, pi.VerdictWouldBlock},
+		{"block", pi.PhaseResponse, pi.VerdictBlock},
+	}
+	if len(sink.decisions) != len(want) {
+		t.Fatalf("expected %d decisions, got %d\n", len(want), len(sink.decisions))
+	}
+	for i, w := range want {
+		d := sink.decisions[i]
+		if d.Plug != w.plug || d.Phase != w.phase || d.Verdict != w.verdict {
+			t.Errorf("decision %d is %s %s %s, want %s %s %s\n", i, d.Plug, d.Phase, d.Verdict, w.plug, w.phase, w.verdict)
+		}
+		if d.RequestID != "abc" || d.Method != "GET" || d.Host != "10.0.0.1" || d.Path != "/some/path" {
+			t.Errorf("decision %d does not identify the request %+v\n", i, d)
+		}
+		if d.Service != "myid" || d.Namespace != "myns" {
+			t.Errorf("decision %d does not identify the service %+v\n", i, d)
+		}
+	}
+	if sink.decisions[4].Reason != "fake error" {
+		t.Errorf("decision reason is %q\n", sink.decisions[4].Reason)
+	}
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLinesSink(&buf)
+	sink.Emit(pi.NewDecision(reqtest, "plug1", pi.PhaseRequest, pi.VerdictAllow))
+	sink.Emit(pi.NewDecision(reqtest, "plug2", pi.PhaseAsync, pi.VerdictBlock))
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close returned %v\n", err)
+	}
+	// decisions emitted while the sink is replaced are ignored
+	sink.Emit(pi.NewDecision(reqtest, "plug3", pi.PhaseRequest, pi.VerdictAllow))
+
+	scanner := bufio.NewScanner(&buf)
+	var plugs []string
+	for scanner.Scan() {
+		var d pi.Decision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatalf("line %q is not a decision: %v\n", scanner.Text(), err)
+		}
+		plugs = append(plugs, d.Plug)
+	}
+	if len(plugs) != 2 || plugs[0] != "plug1" || plugs[1] != "plug2" {
+		t.Errorf("expected two decisions, got %v\n", plugs)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.json")
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatalf("NewFileSink returned %v\n", err)
+		}
+		sink.Emit(pi.NewDecision(reqtest, "plug", pi.PhaseRequest, pi.VerdictAllow))
+		sink.Close()
+	}
+	data, _ := ioutil.ReadFile(path)
+	if n := bytes.Count(data, []byte("\n")); n != 2 {
+		t.Errorf("expected the file to be appended with 2 lines, found %d\n", n)
+	}
+
+	if _, err := NewFileSink(filepath.Join(t.TempDir(), "missing", "decisions.json")); err == nil {
+		t.Errorf("NewFileSink expected an error\n")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []pi.Decision
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d pi.Decision
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, d)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL)
+	for i := 0; i < 3; i++ {
+		sink.Emit(pi.NewDecision(reqtest, "plug", pi.PhaseResponse, pi.VerdictBlock))
+	}
+	sink.Close()
+	sink.Emit(pi.NewDecision(reqtest, "plug", pi.PhaseResponse, pi.VerdictBlock))
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 3 {
+		t.Fatalf("expected 3 decisions, got %d\n", len(received))
+	}
+	if received[0].Verdict != pi.VerdictBlock || received[0].Phase != pi.PhaseResponse {
+		t.Errorf("unexpected decision %+v\n", received[0])
+	}
+}
+
+func TestNewDecisionSinks(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr bool
+	}{
+		{"stdout", "stdout", false},
+		{"file", "file:" + filepath.Join(dir, "d.json"), false},
+		{"webhook", "http://127.0.0.1:1/", false},
+		{"all", "stdout, file:" + filepath.Join(dir, "d.json") + ",https://127.0.0.1:1/", false},
+		{"unknown", "stdout,syslog", true},
+		{"bad file", "file:" + filepath.Join(dir, "missing", "d.json"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := NewDecisionSinks(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewDecisionSinks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sink != nil {
+				sink.Close()
+			}
+		})
+	}
+}
+
+func TestDecisionsEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.json")
+	os.Setenv("RTPLUGS_DECISIONS", "file:"+path)
+	defer os.Unsetenv("RTPLUGS_DECISIONS")
+
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"testgate"}, nil)
+	if rt == nil || pi.CurrentDecisionSink() == nil {
+		t.Fatalf("expected a decision sink to be set\n")
+	}
+	rt.Transport(new(FakeRoundTrip))
+	rt.RoundTrip(reqtest)
+	rt.Close()
+	if pi.CurrentDecisionSink() != nil {
+		t.Errorf("expected Close to reset the decision sink\n")
+	}
+	data, _ := ioutil.ReadFile(path)
+	if n := bytes.Count(data, []byte("\n")); n != 2 {
+		t.Errorf("expected 2 decisions, found %d\n", n)
+	}
+}
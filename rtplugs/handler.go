@@ -0,0 +1,181 @@
+package rtplugs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"go.opencensus.io/trace"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// errResponseBlocked is returned to a handler writing a response that was blocked
+var errResponseBlocked = errors.New("response blocked")
+
+// Handler() wraps an http.Handler of a server
+//
+// Requests are screened using the plugs before reaching next, and the response
+// of next is screened once next writes the response status code.
+// Use it to protect an ordinary go http server:
+//
+//	rt := rtplugs.New(log)
+//	if rt != nil {
+//		defer rt.Close()
+//		h = rt.Handler(h)
+//	}
+//	http.ListenAndServe(":8080", h)
+//
+// ApproveResponse receives the status code and headers set by next, with http.NoBody
+// as the body - the body written by next streams to the client once the response is
+// approved, and is not seen by the plugs. Informational (1xx) responses written by next,
+// such as 103 Early Hints, are forwarded to the client without calling ApproveResponse.
+// A handler hijacking the connection (e.g. to serve websockets) bypasses ApproveResponse.
+// Blocking the request or the response with a pluginterfaces.BlockError results
+// in a response built from the BlockError. Any other error results in a 502 response code.
+func (rt *RoundTrip) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, reqin *http.Request) {
+		c := rt.acquire()
+		defer c.release()
+
+		ctx, span := startRoundTripSpan(reqin)
+		defer span.End()
+
+		// the plugs approving the request also approve its response
+		plugs := c.match(reqin)
+		reqCtx, reqSpan := trace.StartSpan(ctx, "rtplugs.approveRequests")
+		req, err := rt.approveRequests(reqCtx, plugs, reqin)
+		reqSpan.End()
+		if err != nil {
+			writeBlock(w, reqin, err)
+			return
+		}
+
+		shim := &responseShim{
+			rt:     rt,
+			plugs:  plugs,
+			ctx:    ctx,
+			req:    req,
+			w:      w,
+			header: w.Header().Clone(),
+		}
+		next.ServeHTTP(shim, req.WithContext(trace.NewContext(req.Context(), span)))
+		if !shim.wroteHeader {
+			// the handler wrote nothing, the response is an empty 200
+			shim.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// writeBlock() writes the response sent to the client when a plug blocks
+func writeBlock(w http.ResponseWriter, req *http.Request, err error) {
+	var blockErr *pi.BlockError
+	if !errors.As(err, &blockErr) {
+		blockErr = &pi.BlockError{StatusCode: http.StatusBadGateway}
+	}
+	resp := blockResponse(req, blockErr)
+	replaceHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func replaceHeader(dst http.Header, src http.Header) {
+	for k := range dst {
+		delete(dst, k)
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// A ResponseWriter holding the status code and headers written by a handler
+// until the response is approved by the plugs
+type responseShim struct {
+	rt          *RoundTrip
+	plugs       []*activePlug
+	ctx         context.Context
+	req         *http.Request
+	w           http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	blocked     bool
+}
+
+func (s *responseShim) Header() http.Header {
+	return s.header
+}
+
+func (s *responseShim) WriteHeader(statusCode int) {
+	if s.wroteHeader {
+		return
+	}
+	if statusCode >= 100 && statusCode <= 199 && statusCode != http.StatusSwitchingProtocols {
+		// an informational response precedes the response approved by the plugs
+		replaceHeader(s.w.Header(), s.header.Clone())
+		s.w.WriteHeader(statusCode)
+		return
+	}
+	s.wroteHeader = true
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode: statusCode,
+		Proto:      s.req.Proto,
+		ProtoMajor: s.req.ProtoMajor,
+		ProtoMinor: s.req.ProtoMinor,
+		Header:     s.header,
+		Body:       http.NoBody,
+		Request:    s.req,
+	}
+	respCtx, respSpan := trace.StartSpan(s.ctx, "rtplugs.approveResponse")
+	resp, err := s.rt.approveResponse(respCtx, s.plugs, s.req, resp)
+	respSpan.End()
+	if err != nil {
+		s.blocked = true
+		writeBlock(s.w, s.req, err)
+		return
+	}
+	replaceHeader(s.w.Header(), resp.Header)
+	s.w.WriteHeader(resp.StatusCode)
+}
+
+func (s *responseShim) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.blocked {
+		return 0, errResponseBlocked
+	}
+	return s.w.Write(b)
+}
+
+// Flush() supports handlers streaming their response
+func (s *responseShim) Flush() {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.blocked {
+		return
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack() supports handlers taking over the connection, e.g. to serve websockets
+func (s *responseShim) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("rtplugs the ResponseWriter does not support Hijack")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		// the handler writes the response to the connection, bypassing the plugs
+		s.wroteHeader = true
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,177 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"testing"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+type ctxKey string
+
+// headerPlug marks the request context and the response headers
+type headerPlug struct {
+	fakePlug
+}
+
+func (p *headerPlug) ApproveRequest(req *http.Request) (*http.Request, error) {
+	return req.WithContext(context.WithValue(req.Context(), ctxKey("plug"), p.name)), nil
+}
+
+func (p *headerPlug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	resp.Header.Set("X-Approved-By", p.name)
+	resp.Header.Del("X-Secret")
+	return resp, nil
+}
+
+func TestHandler(t *testing.T) {
+	tooMany := pi.NewBlockError(http.StatusTooManyRequests, "too many")
+	tooMany.Body = "slow down"
+	tests := []struct {
+		name       string
+		plug       pi.RoundTripPlug
+		write      bool
+		wantCalled bool
+		wantStatus int
+		wantBody   string
+		wantHeader string
+	}{
+		{"allow", &fakePlug{name: "allow"}, true, true, http.StatusTeapot, "Hello World", ""},
+		{"allow empty", &fakePlug{name: "allow"}, false, true, http.StatusOK, "", ""},
+		{"headers", &headerPlug{fakePlug{name: "headers"}}, true, true, http.StatusTeapot, "Hello World", "headers"},
+		{"request blocked", &fakePlug{name: "block", reqErr: tooMany}, true, false, http.StatusTooManyRequests, "slow down", ""},
+		{"request error", &fakePlug{name: "block", reqErr: errors.New("fake error")}, true, false, http.StatusBadGateway, "", ""},
+		{"response blocked", &fakePlug{name: "block", respErr: tooMany}, true, true, http.StatusTooManyRequests, "slow down", ""},
+		{"response blocked empty", &fakePlug{name: "block", respErr: tooMany}, false, true, http.StatusTooManyRequests, "slow down", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: tt.plug}}}}
+			var called bool
+			var writeErr error
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				called = true
+				if _, ok := tt.plug.(*headerPlug); ok && req.Context().Value(ctxKey("plug")) != "headers" {
+					t.Errorf("handler did not receive the request approved by the plug")
+				}
+				if !tt.write {
+					return
+				}
+				w.Header().Set("X-Secret", "42")
+				w.WriteHeader(http.StatusTeapot)
+				_, writeErr = io.WriteString(w, "Hello World")
+			})
+			w := httptest.NewRecorder()
+			rt.Handler(next).ServeHTTP(w, httptest.NewRequest("GET", "http://10.0.0.1/", nil))
+			if called != tt.wantCalled {
+				t.Errorf("handler called %t, want %t", called, tt.wantCalled)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("body %q, want %q", got, tt.wantBody)
+			}
+			if got := w.Header().Get("X-Approved-By"); got != tt.wantHeader {
+				t.Errorf("X-Approved-By %q, want %q", got, tt.wantHeader)
+			}
+			if tt.wantHeader != "" && w.Header().Get("X-Secret") != "" {
+				t.Errorf("header removed by the plug was sent")
+			}
+			if tt.write && tt.wantStatus != http.StatusTeapot && called && writeErr == nil {
+				t.Errorf("write of a blocked response did not fail")
+			}
+		})
+	}
+}
+
+// statusPlug records the status codes of the responses it approves
+type statusPlug struct {
+	fakePlug
+	mu       sync.Mutex
+	statuses []int
+}
+
+func (p *statusPlug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	p.mu.Lock()
+	p.statuses = append(p.statuses, resp.StatusCode)
+	p.mu.Unlock()
+	if resp.Body != http.NoBody {
+		return nil, errors.New("ApproveResponse received a body")
+	}
+	return resp, nil
+}
+
+func TestHandlerInformational(t *testing.T) {
+	plug := &statusPlug{fakePlug: fakePlug{name: "status"}}
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: plug}}}}
+	srv := httptest.NewServer(rt.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	defer srv.Close()
+
+	var informational []int
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		if header.Get("Link") == "" {
+			t.Errorf("the informational response has no Link header")
+		}
+		informational = append(informational, code)
+		return nil
+	}}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		t.Fatalf("Do returned %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot || len(informational) != 1 || informational[0] != http.StatusEarlyHints {
+		t.Errorf("status %d after informational responses %v", resp.StatusCode, informational)
+	}
+	if len(plug.statuses) != 1 || plug.statuses[0] != http.StatusTeapot {
+		t.Errorf("ApproveResponse received statuses %v", plug.statuses)
+	}
+}
+
+func TestHandlerHijack(t *testing.T) {
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: &fakePlug{name: "allow"}}}}}
+	srv := httptest.NewServer(rt.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			t.Errorf("the ResponseWriter does not support Hijack")
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			t.Errorf("Hijack returned %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get returned %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hijacked" {
+		t.Errorf("body %q, want the body written to the hijacked connection", body)
+	}
+
+	// a ResponseWriter without Hijack
+	shim := &responseShim{w: httptest.NewRecorder()}
+	if _, _, err := shim.Hijack(); err == nil {
+		t.Errorf("Hijack of a ResponseWriter without Hijack returned nil")
+	}
+}
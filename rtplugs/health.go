@@ -0,0 +1,131 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// How often plugs are checked for health, unless set by env RTPLUGS_HEALTH_INTERVAL
+const defaultHealthInterval = 10 * time.Second
+
+// healthInterval() returns the interval between health checks
+func healthInterval() time.Duration {
+	if v := os.Getenv("RTPLUGS_HEALTH_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		pi.Log.Warnf("rtplugs ignoring illegal RTPLUGS_HEALTH_INTERVAL %q", v)
+	}
+	return defaultHealthInterval
+}
+
+// startHealthChecks() checks the health of the active plugs in the background, right away
+// and then every interval until the RoundTrip is closed
+//
+// The checks start once plugs include a plug implementing pluginterfaces.HealthChecker,
+// and check the plugs activated later as well.
+func (rt *RoundTrip) startHealthChecks(plugs []*activePlug) {
+	if !hasHealthChecker(plugs) {
+		return
+	}
+	rt.healthChecks.Do(func() {
+		interval := healthInterval()
+		rt.every(interval, true, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			defer cancel()
+			rt.checkHealth(ctx)
+		})
+	})
+}
+
+func hasHealthChecker(plugs []*activePlug) bool {
+	for _, ap := range plugs {
+		if _, ok := ap.plug.(pi.HealthChecker); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHealth() checks the health of the active plugs implementing pluginterfaces.HealthChecker
+func (rt *RoundTrip) checkHealth(ctx context.Context) {
+	for _, ap := range rt.currentPlugs() {
+		ap.checkHealth(ctx)
+	}
+}
+
+func (ap *activePlug) checkHealth(ctx context.Context) {
+	hc, ok := ap.plug.(pi.HealthChecker)
+	if !ok {
+		return
+	}
+	var err error
+	if failure := ap.protect(func() { err = hc.Health(ctx) }); failure != nil {
+		err = failure
+	}
+
+	ap.mu.Lock()
+	wasHealthy := ap.health == nil
+	ap.health = err
+	ap.mu.Unlock()
+	switch {
+	case err != nil && wasHealthy:
+		pi.Log.Warnf("rtplugs Plug %s: unhealthy: %v", ap.name(), err)
+	case err == nil && !wasHealthy:
+		pi.Log.Infof("rtplugs Plug %s: healthy again", ap.name())
+	}
+}
+
+// Ready() returns an error when the plugs can't protect the service
+//
+// The plugs are not ready when a plug failed to initialize and blocks all requests,
+// or when a plug reported an error in its last health check.
+// Plugs in monitor mode never block requests, hence do not affect readiness.
+// A nil RoundTrip (i.e. no plugs were activated) is always ready.
+func (rt *RoundTrip) Ready() error {
+	if rt == nil {
+		return nil
+	}
+	var problems []string
+	for _, ap := range rt.currentPlugs() {
+		ap.mu.RLock()
+		monitor := ap.monitor
+		health := ap.health
+		ap.mu.RUnlock()
+		if monitor {
+			continue
+		}
+		if ap.initErr != nil {
+			problems = append(problems, ap.name()+": "+ap.initErr.Error())
+		} else if health != nil {
+			problems = append(problems, ap.name()+": "+health.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("rtplugs plugs are not ready: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ReadyHandler() returns an http.Handler reporting readiness, for use as a readiness probe
+//
+// The handler responds with 200 when Ready() returns nil and with 503 otherwise.
+func (rt *RoundTrip) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := rt.Ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,164 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// healthPlug reports the health set by setHealth
+type healthPlug struct {
+	fakePlug
+	mu     sync.Mutex
+	health error
+	panic  bool
+}
+
+func (p *healthPlug) Health(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.panic {
+		panic("fake panic")
+	}
+	return p.health
+}
+
+func (p *healthPlug) setHealth(err error) {
+	p.mu.Lock()
+	p.health = err
+	p.mu.Unlock()
+}
+
+var sharedHealthPlug = &healthPlug{fakePlug: fakePlug{name: "healthplug", version: "0.0.1"}}
+
+func init() {
+	pi.RegisterPlug(func() pi.RoundTripPlug {
+		return sharedHealthPlug
+	})
+}
+
+func readyStatus(rt *RoundTrip) int {
+	w := httptest.NewRecorder()
+	rt.ReadyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	return w.Code
+}
+
+func TestReady(t *testing.T) {
+	hp := &healthPlug{fakePlug: fakePlug{name: "health"}}
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{
+		{plug: &fakePlug{name: "plain"}},
+		{plug: hp},
+	}}}
+	rt.checkHealth(context.Background())
+	if err := rt.Ready(); err != nil || readyStatus(rt) != http.StatusOK {
+		t.Errorf("Ready returned %v for healthy plugs", err)
+	}
+
+	hp.setHealth(errors.New("stale rules"))
+	rt.checkHealth(context.Background())
+	if err := rt.Ready(); err == nil || readyStatus(rt) != http.StatusServiceUnavailable {
+		t.Errorf("Ready returned %v for an unhealthy plug", err)
+	}
+	if status := getStatus(t, rt); status.Plugs[1].HealthError != "stale rules" {
+		t.Errorf("AdminHandler returned health %q", status.Plugs[1].HealthError)
+	}
+
+	// unhealthy plugs in monitor mode do not affect readiness
+	rt.chain.plugs[1].plugPolicy.monitor = true
+	if err := rt.Ready(); err != nil {
+		t.Errorf("Ready returned %v for an unhealthy plug in monitor mode", err)
+	}
+	rt.chain.plugs[1].plugPolicy.monitor = false
+
+	hp.setHealth(nil)
+	hp.panic = true
+	rt.checkHealth(context.Background())
+	if err := rt.Ready(); err == nil {
+		t.Errorf("Ready returned nil for a plug panicking in Health")
+	}
+	hp.panic = false
+	rt.checkHealth(context.Background())
+	if err := rt.Ready(); err != nil {
+		t.Errorf("Ready returned %v once healthy again", err)
+	}
+
+	// a plug blocking all requests is not ready
+	rt.chain.plugs[0].initErr = errInit
+	if err := rt.Ready(); err == nil {
+		t.Errorf("Ready returned nil for a plug failing to initialize")
+	}
+
+	var none *RoundTrip
+	if err := none.Ready(); err != nil || readyStatus(none) != http.StatusOK {
+		t.Errorf("Ready returned %v without plugs", err)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	os.Setenv("RTPLUGS_HEALTH_INTERVAL", "5ms")
+	defer os.Unsetenv("RTPLUGS_HEALTH_INTERVAL")
+	sharedHealthPlug.setHealth(errors.New("expired certificate"))
+	defer sharedHealthPlug.setHealth(nil)
+
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"healthplug"}, nil)
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil\n")
+	}
+	defer rt.Close()
+	// the first check runs in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for rt.Ready() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the plug health was not checked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sharedHealthPlug.setHealth(nil)
+	deadline = time.Now().Add(2 * time.Second)
+	for rt.Ready() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the plug health was not checked again")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthChecksStart(t *testing.T) {
+	os.Setenv("RTPLUGS_HEALTH_INTERVAL", "5ms")
+	defer os.Unsetenv("RTPLUGS_HEALTH_INTERVAL")
+	sharedHealthPlug.setHealth(errors.New("expired certificate"))
+	defer sharedHealthPlug.setHealth(nil)
+
+	// no plug implements HealthChecker, no checks run in the background
+	_, rt := NewReconfigurablePlugs(context.Background(), nil, "myid", "myns", []string{"testgate"}, nil)
+	if rt == nil {
+		t.Fatalf("NewReconfigurablePlugs returned nil\n")
+	}
+	defer rt.Close()
+	rt.stopMu.Lock()
+	started := rt.stop != nil
+	rt.stopMu.Unlock()
+	if started {
+		t.Errorf("health checks started without a plug implementing HealthChecker")
+	}
+
+	// the checks start once such a plug is added
+	if err := rt.AddPlug("healthplug", nil); err != nil {
+		t.Fatalf("AddPlug returned %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for rt.Ready() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the added plug health was not checked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,108 @@
+package rtplugs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"sync"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// The .so files LoadPlugs already tried to load, by absolute path
+var loaded struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+// LoadPlugs(dir) dynamically loads all .so files found in dir
+//
+// Each .so file is expected to be built using `go build -buildmode=plugin`
+// and to export a function:
+//
+//	func NewPlug()  pluginterfaces.RoundTripPlug {}
+//
+// NewPlug is registered as the plug constructor and may later be used to
+// activate the plug by name, same as plugs added statically (using imports).
+// Files that fail to load are logged and skipped.
+// Each file is loaded once - calling LoadPlugs again, as each call to New with
+// RTPLUGS_DIR set does, only loads the files added to dir since.
+func LoadPlugs(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("rtplugs can't read plug directory %s: %w", dir, err)
+	}
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	if loaded.paths == nil {
+		loaded.paths = make(map[string]bool)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".so") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			abs = path
+		}
+		if loaded.paths[abs] {
+			continue
+		}
+		loaded.paths[abs] = true
+		if err := loadPlug(path); err != nil {
+			pi.Log.Warnf("rtplugs skipping %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func loadPlug(path string) (err error) {
+	// Never panic the caller app from here
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("paniced while loading: %v", r)
+		}
+	}()
+
+	so, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := so.Lookup("NewPlug")
+	if err != nil {
+		return err
+	}
+	newPlug, ok := sym.(func() pi.RoundTripPlug)
+	if !ok {
+		return fmt.Errorf("NewPlug has type %T, expected func() pluginterfaces.RoundTripPlug", sym)
+	}
+	p := newPlug()
+	if p == nil {
+		return errors.New("NewPlug returned nil")
+	}
+	if err = checkVersion(p); err != nil {
+		return err
+	}
+	pi.RegisterPlug(newPlug)
+	pi.Log.Infof("rtplugs loaded Plug %s version %s from %s", p.PlugName(), p.PlugVersion(), path)
+	return nil
+}
+
+// checkVersion() verifies a dynamically loaded plug identifies itself
+// and does not shadow a plug that was already registered
+func checkVersion(p pi.RoundTripPlug) error {
+	if p.PlugName() == "" {
+		return errors.New("plug has no name")
+	}
+	if p.PlugVersion() == "" {
+		return fmt.Errorf("plug %s has no version", p.PlugName())
+	}
+	if newRegistered, ok := pi.RoundTripPlugs[p.PlugName()]; ok {
+		return fmt.Errorf("plug %s version %s is already registered (version %s)", p.PlugName(), p.PlugVersion(), newRegistered().PlugVersion())
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package rtplugs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"testing"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+func TestLoadPlugsDir(t *testing.T) {
+	if err := LoadPlugs(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("LoadPlugs expected an error for a missing directory\n")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "bad.so"), []byte("not a plugin"), 0644)
+	os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("not a plugin"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub.so"), 0755)
+
+	numPlugs := len(pi.RoundTripPlugs)
+	if err := LoadPlugs(dir); err != nil {
+		t.Errorf("LoadPlugs returned error %v\n", err)
+	}
+	if len(pi.RoundTripPlugs) != numPlugs {
+		t.Errorf("LoadPlugs registered a plug from a bad file\n")
+	}
+	if err := loadPlug(filepath.Join(dir, "bad.so")); err == nil {
+		t.Errorf("loadPlug expected an error for a bad file\n")
+	}
+}
+
+// warnLog records the warnings logged
+type warnLog struct {
+	countLog
+	warnings []string
+}
+
+func (l *warnLog) Warnf(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestLoadPlugsBuilt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building a plugin is slow")
+	}
+	dir := t.TempDir()
+	cmd := exec.Command("go", "build", "-buildmode=plugin", "-o", filepath.Join(dir, "dynplug.so"), "./testdata/dynplug")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("can't build a plugin: %v\n%s", err, out)
+	}
+	if _, err := plugin.Open(filepath.Join(dir, "dynplug.so")); err != nil {
+		// e.g. the test binary was built using different flags, such as -race
+		t.Skipf("can't open the plugin: %v", err)
+	}
+
+	log := &warnLog{}
+	defer func(saved pi.Logger) { pi.Log = saved }(pi.Log)
+	pi.Log = log
+	if err := LoadPlugs(dir); err != nil {
+		t.Fatalf("LoadPlugs returned error %v\n", err)
+	}
+	if len(log.warnings) != 0 {
+		t.Errorf("LoadPlugs warned %v\n", log.warnings)
+	}
+	if _, ok := pi.RoundTripPlugs["dynplug"]; !ok {
+		t.Fatalf("LoadPlugs did not register the plug\n")
+	}
+
+	// each New with RTPLUGS_DIR set loads the directory again, skipping the files already loaded
+	t.Setenv("RTPLUGS_DIR", dir)
+	for i := 0; i < 2; i++ {
+		_, rt := NewConfigrablePlugs(context.Background(), log, "myid", "myns", []string{"dynplug"}, nil)
+		if rt == nil {
+			t.Fatalf("NewConfigrablePlugs returned nil\n")
+		}
+		req := reqtest.Clone(context.Background())
+		if req, _ = rt.currentPlugs()[0].approveRequest(req); req.Header.Get("X-Dynplug") != "approved" {
+			t.Errorf("the loaded plug did not approve the request\n")
+		}
+		rt.Close()
+	}
+	if len(log.warnings) != 0 {
+		t.Errorf("loading the directory again warned %v\n", log.warnings)
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		plug    *fakePlug
+		wantErr bool
+	}{
+		{"ok", &fakePlug{name: "newplug", version: "0.0.1"}, false},
+		{"no name", &fakePlug{name: "", version: "0.0.1"}, true},
+		{"no version", &fakePlug{name: "newplug", version: ""}, true},
+		{"already registered", &fakePlug{name: "rtgate", version: "9.9.9"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkVersion(tt.plug); (err != nil) != tt.wantErr {
+				t.Errorf("checkVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package rtplugs
+
+import (
+	"errors"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The results counted by the rtplugs_plug_calls_total metric
+const (
+	resultApproved   = "approved"
+	resultBlocked    = "blocked"
+	resultWouldBlock = "wouldblock"
+	resultErrored    = "errored"
+	resultPanicked   = "panicked"
+)
+
+// Prometheus metrics of the plug chain, shared by all RoundTrip objects
+type metricsCollector struct {
+	plugLatency     *prometheus.HistogramVec
+	plugCalls       *prometheus.CounterVec
+	upstreamLatency prometheus.Histogram
+}
+
+var metrics = newMetricsCollector()
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{
+		plugLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rtplugs",
+			Name:      "plug_approval_duration_seconds",
+			Help:      "Latency of ApproveRequest and ApproveResponse calls per plug",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"plug", "phase"}),
+		plugCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rtplugs",
+			Name:      "plug_calls_total",
+			Help:      "ApproveRequest and ApproveResponse calls per plug by result (approved, blocked, wouldblock, errored, panicked)",
+		}, []string{"plug", "phase", "result"}),
+		upstreamLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "rtplugs",
+			Name:      "upstream_duration_seconds",
+			Help:      "Latency of the next RoundTripper (i.e. the upstream server)",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+}
+
+// MetricsCollector() returns a Prometheus collector of the plug chain metrics
+//
+// The application registers it with its registry to expose the metrics:
+//
+//	prometheus.MustRegister(rtplugs.MetricsCollector())
+func MetricsCollector() prometheus.Collector {
+	return metrics
+}
+
+func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	m.plugLatency.Describe(ch)
+	m.plugCalls.Describe(ch)
+	m.upstreamLatency.Describe(ch)
+}
+
+func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m.plugLatency.Collect(ch)
+	m.plugCalls.Collect(ch)
+	m.upstreamLatency.Collect(ch)
+}
+
+// observePlug() records a plug call given the verdict and the reason reported for it
+//
+// Only a plug denying the call using a pluginterfaces.BlockError counts as blocked,
+// while any other error blocking the call counts as errored.
+func (m *metricsCollector) observePlug(plug string, phase string, verdict string, reason error, elapsed time.Duration) {
+	var blockErr *pi.BlockError
+	var result string
+	switch {
+	case errors.Is(reason, errPanic):
+		result = resultPanicked
+	case isFailure(reason):
+		result = resultErrored
+	case verdict == pi.VerdictAllow:
+		result = resultApproved
+	case verdict == pi.VerdictWouldBlock:
+		result = resultWouldBlock
+	case errors.As(reason, &blockErr):
+		result = resultBlocked
+	default:
+		result = resultErrored
+	}
+	m.plugLatency.WithLabelValues(plug, phase).Observe(elapsed.Seconds())
+	m.plugCalls.WithLabelValues(plug, phase, result).Inc()
+}
+
+func (m *metricsCollector) observeUpstream(elapsed time.Duration) {
+	m.upstreamLatency.Observe(elapsed.Seconds())
+}
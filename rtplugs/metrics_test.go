@@ -0,0 +1,103 @@
+package rtplugs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather() returns the value of the metric named name with the given labels
+func gather(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather returned %v\n", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metricLoop:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+					continue metricLoop
+				}
+			}
+			return metricValue(m)
+		}
+	}
+	return 0
+}
+
+func metricValue(m *dto.Metric) float64 {
+	if m.GetCounter() != nil {
+		return m.GetCounter().GetValue()
+	}
+	if m.GetHistogram() != nil {
+		return float64(m.GetHistogram().GetSampleCount())
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(MetricsCollector()); err != nil {
+		t.Fatalf("Register returned %v\n", err)
+	}
+
+	upstream := gather(t, reg, "rtplugs_upstream_duration_seconds", nil)
+	rt := &RoundTrip{
+		chain: &chain{plugs: []*activePlug{
+			{plug: &fakePlug{name: "metrics-block", respErr: &pi.BlockError{}}},
+			{plug: &fakePlug{name: "metrics-monitor", reqErr: errors.New("fake error")}, plugPolicy: plugPolicy{monitor: true}},
+			{plug: &fakePlug{name: "metrics-allow"}},
+		}},
+	}
+	rt.Transport(new(FakeRoundTrip))
+	for i := 0; i < 2; i++ {
+		rt.RoundTrip(reqtest)
+	}
+
+	tests := []struct {
+		plug, phase, result string
+	}{
+		{"metrics-allow", pi.PhaseRequest, resultApproved},
+		{"metrics-allow", pi.PhaseResponse, resultApproved},
+		{"metrics-monitor", pi.PhaseRequest, resultWouldBlock},
+		{"metrics-block", pi.PhaseResponse, resultBlocked},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.plug, tt.phase), func(t *testing.T) {
+			labels := map[string]string{"plug": tt.plug, "phase": tt.phase, "result": tt.result}
+			if v := gather(t, reg, "rtplugs_plug_calls_total", labels); v != 2 {
+				t.Errorf("rtplugs_plug_calls_total%v = %v, want 2\n", labels, v)
+			}
+			labels = map[string]string{"plug": tt.plug, "phase": tt.phase}
+			if v := gather(t, reg, "rtplugs_plug_approval_duration_seconds", labels); v == 0 {
+				t.Errorf("rtplugs_plug_approval_duration_seconds%v was not observed\n", labels)
+			}
+		})
+	}
+	if v := gather(t, reg, "rtplugs_upstream_duration_seconds", nil); v != upstream+2 {
+		t.Errorf("rtplugs_upstream_duration_seconds = %v, want %v\n", v, upstream+2)
+	}
+
+	metrics.observePlug("metrics-fail", pi.PhaseRequest, pi.VerdictSkip, errTimeout, time.Millisecond)
+	metrics.observePlug("metrics-fail", pi.PhaseRequest, pi.VerdictBlock, fmt.Errorf("%w: oops", errPanic), time.Millisecond)
+	if v := gather(t, reg, "rtplugs_plug_calls_total", map[string]string{"plug": "metrics-fail", "result": resultErrored}); v != 1 {
+		t.Errorf("expected a timeout to count as errored\n")
+	}
+	// only a BlockError counts as blocked
+	metrics.observePlug("metrics-fail", pi.PhaseResponse, pi.VerdictBlock, errors.New("fake error"), time.Millisecond)
+	if v := gather(t, reg, "rtplugs_plug_calls_total", map[string]string{"plug": "metrics-fail", "phase": pi.PhaseResponse, "result": resultErrored}); v != 1 {
+		t.Errorf("expected a plain error to count as errored\n")
+	}
+	if v := gather(t, reg, "rtplugs_plug_calls_total", map[string]string{"plug": "metrics-fail", "result": resultPanicked}); v != 1 {
+		t.Errorf("expected a panic to count as panicked\n")
+	}
+}
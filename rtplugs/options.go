@@ -0,0 +1,143 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// An Option sets a parameter of NewWithOptions
+type Option func(*options)
+
+// The parameters of NewWithOptions
+type options struct {
+	ctx         context.Context
+	logger      pi.Logger
+	serviceName string
+	namespace   string
+	plugs       []string
+	plugsSet    bool
+	config      map[string]map[string]string
+}
+
+// WithContext(ctx) sets the context passed to the plugs when initialized
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithLogger(logger) sets the logger used by rtplugs and all plugs
+func WithLogger(logger pi.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithService(serviceName, namespace) sets the protected service,
+// instead of env SERVICENAME and NAMESPACE or the podinfo files
+func WithService(serviceName string, namespace string) Option {
+	return func(o *options) {
+		o.serviceName = serviceName
+		o.namespace = namespace
+	}
+}
+
+// WithPlugs(plugs...) sets the plug list, instead of env RTPLUGS_CONFIG or RTPLUGS
+func WithPlugs(plugs ...string) Option {
+	return func(o *options) {
+		o.plugs = plugs
+		o.plugsSet = true
+	}
+}
+
+// WithConfig(c) sets the config of each plug instance, by instance name,
+// instead of the config file set by env RTPLUGS_CONFIG
+func WithConfig(c map[string]map[string]string) Option {
+	return func(o *options) {
+		o.config = c
+	}
+}
+
+// NewWithOptions(opts...) activates a list of plugs, returning an error when it can't
+//
+// Parameters not set by options are taken from the environment as in New:
+// the plug list and config from the file set by env RTPLUGS_CONFIG (see ChainConfig),
+// or else the plug list from env RTPLUGS, the service from env SERVICENAME or /etc/podinfo/servicename
+// and the namespace from env NAMESPACE or /etc/podinfo/namespace.
+//
+// A config file set by env RTPLUGS_CONFIG is watched for changes until the RoundTrip is closed.
+// A nil RoundTrip and no error are returned when the plug list is empty.
+// An error is returned when the service or namespace can't be found.
+// When some plugs fail to activate, the RoundTrip of the remaining plugs (if any)
+// is returned along with an error describing the failures, such that the
+// caller may decide whether to abort or to continue.
+func NewWithOptions(opts ...Option) (*RoundTrip, error) {
+	o := &options{ctx: context.Background()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.logger != nil {
+		pi.Log = o.logger
+	}
+
+	var configFile string
+	if !o.plugsSet {
+		if configFile = os.Getenv("RTPLUGS_CONFIG"); configFile != "" {
+			cc, err := LoadChainConfig(configFile)
+			if err != nil {
+				return nil, err
+			}
+			plugs, c := cc.PlugsAndConfig()
+			if len(plugs) == 0 {
+				return nil, nil
+			}
+			o.plugs = plugs
+			if o.config == nil {
+				o.config = c
+			}
+		}
+	}
+	if !o.plugsSet && configFile == "" {
+		comma := func(c rune) bool {
+			return c == ','
+		}
+		o.plugs = strings.FieldsFunc(os.Getenv("RTPLUGS"), comma)
+	}
+	if len(o.plugs) == 0 {
+		return nil, nil
+	}
+
+	if o.namespace == "" {
+		o.namespace = podInfo("NAMESPACE", "/etc/podinfo/namespace")
+	}
+	if o.serviceName == "" {
+		o.serviceName = podInfo("SERVICENAME", "/etc/podinfo/servicename")
+	}
+	if o.namespace == "" {
+		return nil, errors.New("rtplugs can't find the mandatory namespace, set env NAMESPACE or mount /etc/podinfo/namespace")
+	}
+	if o.serviceName == "" {
+		return nil, errors.New("rtplugs can't find the mandatory service name, set env SERVICENAME or mount /etc/podinfo/servicename")
+	}
+
+	_, rt, err := newRoundTrip(o.ctx, o.logger, o.serviceName, o.namespace, o.plugs, o.config, false)
+	if rt != nil && configFile != "" {
+		rt.WatchFile(configFile, configPollInterval, ParseConfigFile)
+	}
+	return rt, err
+}
+
+// podInfo() returns the value of env key, or else the content of the podinfo file at path
+func podInfo(key string, path string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	if dat, err := os.ReadFile(path); err == nil {
+		return strings.TrimSpace(string(dat))
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// initPlug fails to initialize when its config sets "fail"
+type initPlug struct {
+	fakePlug
+}
+
+func (p *initPlug) Initialize(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) (context.Context, error) {
+	if v, ok := c["fail"]; ok {
+		return ctx, errors.New(v)
+	}
+	return ctx, nil
+}
+
+func init() {
+	pi.RegisterPlug(func() pi.RoundTripPlug {
+		return &initPlug{fakePlug{name: "initplug", version: "0.0.1"}}
+	})
+}
+
+func TestNewWithOptions(t *testing.T) {
+	InitializeEnv()
+	defer InitializeEnv()
+
+	// from env
+	rt, err := NewWithOptions()
+	if rt == nil || err != nil {
+		t.Fatalf("NewWithOptions returned %v, %v", rt, err)
+	}
+	rt.Close()
+
+	rt, err = NewWithOptions(WithPlugs())
+	if rt != nil || err != nil {
+		t.Errorf("NewWithOptions without plugs returned %v, %v", rt, err)
+	}
+
+	rt, err = NewWithOptions(WithPlugs("testgate", "noplug"), WithService("svc", "ns"))
+	if rt == nil || err == nil || !strings.Contains(err.Error(), "noplug") {
+		t.Fatalf("NewWithOptions with an unknown plug returned %v, %v", rt, err)
+	}
+	if rt.serviceName != "svc" || rt.namespace != "ns" || len(rt.currentPlugs()) != 1 {
+		t.Errorf("NewWithOptions activated %v for %s.%s", instanceNames(rt), rt.serviceName, rt.namespace)
+	}
+	rt.Close()
+
+	// a plug failing to initialize blocks all requests, unless it fails open
+	c := map[string]map[string]string{"initplug": {"fail": "illegal config"}}
+	rt, err = NewWithOptions(WithPlugs("initplug"), WithConfig(c), WithContext(context.Background()))
+	if rt == nil || err == nil || !strings.Contains(err.Error(), "illegal config") {
+		t.Fatalf("NewWithOptions with a failing plug returned %v, %v", rt, err)
+	}
+	if ap := rt.currentPlugs()[0]; !errors.Is(ap.initErr, errInit) {
+		t.Errorf("plug failing to initialize has initErr %v", ap.initErr)
+	}
+	rt.Close()
+
+	c["initplug"]["onfailure"] = "open"
+	rt, err = NewWithOptions(WithPlugs("initplug"), WithConfig(c))
+	if rt != nil || err == nil {
+		t.Errorf("NewWithOptions with a failing plug that fails open returned %v, %v", rt, err)
+	}
+
+	rt, err = NewWithOptions(WithPlugs("initplug"))
+	if rt == nil || err != nil {
+		t.Errorf("NewWithOptions returned %v, %v", rt, err)
+	}
+	rt.Close()
+}
+
+func TestNewWithoutNamespace(t *testing.T) {
+	InitializeEnv()
+	defer InitializeEnv()
+	os.Unsetenv("NAMESPACE")
+
+	rt, err := NewWithOptions()
+	if rt != nil || err == nil || !strings.Contains(err.Error(), "namespace") {
+		t.Errorf("NewWithOptions without a namespace returned %v, %v", rt, err)
+	}
+	if rt = New(nil); rt != nil {
+		t.Errorf("New without a namespace returned %v", rt)
+	}
+	rt, err = NewWithOptions(WithService("svc", "ns"))
+	if rt == nil || err != nil {
+		t.Errorf("NewWithOptions WithService returned %v, %v", rt, err)
+	}
+	rt.Close()
+}
@@ -0,0 +1,407 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// Config keys reserved by rtplugs in the config of every plug
+const (
+	timeoutKey   = "timeout"   // a duration such as "100ms", the time budget of each plug call
+	onFailureKey = "onfailure" // "open" skips a failing plug, "closed" (default) blocks
+	onTimeoutKey = "ontimeout" // overrides onfailure for plug calls that ran out of time
+	modeKey      = "mode"      // "monitor" logs block decisions without blocking, "enforce" (default) blocks
+	priorityKey  = "priority"  // an integer overriding the priority of the plug, lower runs first
+)
+
+var reservedKeys = []string{timeoutKey, onFailureKey, onTimeoutKey, modeKey, priorityKey,
+	matchPathKey, matchHostKey, matchMethodKey, matchHeaderKey, skipPathKey}
+
+func isReservedKey(key string) bool {
+	for _, reserved := range reservedKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// Failures of a plug, as opposed to a plug deciding to block
+var (
+	errTimeout = errors.New("timed out")
+	errPanic   = errors.New("paniced")
+	errInit    = errors.New("failed to initialize")
+)
+
+func isFailure(err error) bool {
+	return errors.Is(err, errTimeout) || errors.Is(err, errPanic) || errors.Is(err, errInit)
+}
+
+// The policy rtplugs applies when calling a plug, set by the reserved config keys
+type plugPolicy struct {
+	timeout     time.Duration // zero means no timeout
+	failOpen    bool          // skip the plug when it fails, instead of blocking
+	timeoutOpen bool          // skip the plug when it times out, instead of blocking
+	monitor     bool          // log block decisions of the plug without blocking
+	priority    int           // the position of the plug in the chain, lower runs first
+	route       *route        // the requests approved by the plug, nil for all requests
+}
+
+// An activated plug and the policy rtplugs applies when calling it
+type activePlug struct {
+	plug     pi.RoundTripPlug
+	instance string // the instance name, defaults to the plug name
+	initErr  error  // set when a fail-closed plug failed to initialize
+
+	mu          sync.RWMutex      // guards the policy, config, last error and health
+	plugPolicy                    // the current policy
+	config      map[string]string // the last config accepted by the plug
+	lastErr     error             // the last error reported by the plug
+	lastErrTime time.Time         // the time of the last error
+	health      error             // the result of the last health check
+
+	approved   uint64 // number of calls approving, updated atomically
+	blocked    uint64 // number of calls blocking, updated atomically
+	skipped    uint64 // number of failed calls skipped, updated atomically
+	timeouts   uint64 // number of calls that ran out of time, updated atomically
+	panics     uint64 // number of calls that paniced, updated atomically
+	wouldBlock uint64 // number of block decisions ignored in monitor mode, updated atomically
+}
+
+func newActivePlug(p pi.RoundTripPlug, instance string, c map[string]string) *activePlug {
+	ap := &activePlug{plug: p, instance: instance, config: c}
+	ap.plugPolicy = ap.parsePolicy(c)
+	return ap
+}
+
+// parsePolicy() returns the policy set by the reserved keys of config c
+func (ap *activePlug) parsePolicy(c map[string]string) (policy plugPolicy) {
+	if v, ok := c[timeoutKey]; ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			pi.Log.Warnf("rtplugs Plug %s: ignoring illegal %s %q", ap.name(), timeoutKey, v)
+		} else {
+			policy.timeout = timeout
+		}
+	}
+	policy.failOpen = ap.parseOpen(c, onFailureKey, false)
+	policy.timeoutOpen = ap.parseOpen(c, onTimeoutKey, policy.failOpen)
+	switch v := c[modeKey]; v {
+	case "", "enforce":
+	case "monitor":
+		policy.monitor = true
+	default:
+		pi.Log.Warnf("rtplugs Plug %s: ignoring illegal %s %q", ap.name(), modeKey, v)
+	}
+	policy.route = ap.parseRoute(c)
+	policy.priority = ap.defaultPriority()
+	if v, ok := c[priorityKey]; ok {
+		priority, err := strconv.Atoi(v)
+		if err != nil {
+			pi.Log.Warnf("rtplugs Plug %s: ignoring illegal %s %q", ap.name(), priorityKey, v)
+		} else {
+			policy.priority = priority
+		}
+	}
+	return
+}
+
+// defaultPriority() returns the priority declared by plugs implementing pluginterfaces.Prioritizer, or 0
+func (ap *activePlug) defaultPriority() (priority int) {
+	if p, ok := ap.plug.(pi.Prioritizer); ok {
+		ap.protect(func() { priority = p.PlugPriority() })
+	}
+	return
+}
+
+// parseOpen() returns true for "open" and false for "closed"
+func (ap *activePlug) parseOpen(c map[string]string, key string, defaultOpen bool) bool {
+	switch v := c[key]; v {
+	case "":
+		return defaultOpen
+	case "open":
+		return true
+	case "closed":
+		return false
+	default:
+		pi.Log.Warnf("rtplugs Plug %s: ignoring illegal %s %q", ap.name(), key, v)
+		return defaultOpen
+	}
+}
+
+// policy() returns the current policy of the plug
+func (ap *activePlug) policy() plugPolicy {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	return ap.plugPolicy
+}
+
+// createPlug() creates a new plug instance using the registered constructor
+func createPlug(newPlug func() pi.RoundTripPlug) (p pi.RoundTripPlug, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%w: %v", errPanic, recovered)
+		}
+	}()
+	if p = newPlug(); p == nil {
+		err = errors.New("constructor returned nil")
+	}
+	return
+}
+
+func (ap *activePlug) name() string {
+	if ap.instance != "" {
+		return ap.instance
+	}
+	return ap.plug.PlugName()
+}
+
+// skipOnFailure() returns true when the policy is to skip the plug following err
+// A plug in monitor mode is always skipped
+func (ap *activePlug) skipOnFailure(err error) bool {
+	policy := ap.policy()
+	if policy.monitor {
+		return true
+	}
+	if errors.Is(err, errTimeout) {
+		return policy.timeoutOpen
+	}
+	return policy.failOpen
+}
+
+// record() counts the verdict of a plug call and keeps the last error reported by the plug
+func (ap *activePlug) record(verdict string, reason error) {
+	switch verdict {
+	case pi.VerdictAllow:
+		atomic.AddUint64(&ap.approved, 1)
+	case pi.VerdictBlock:
+		atomic.AddUint64(&ap.blocked, 1)
+	case pi.VerdictSkip:
+		atomic.AddUint64(&ap.skipped, 1)
+	}
+	if reason != nil {
+		ap.mu.Lock()
+		ap.lastErr = reason
+		ap.lastErrTime = time.Now()
+		ap.mu.Unlock()
+	}
+}
+
+// protect() runs f, turning a panic into an error
+func (ap *activePlug) protect(f func()) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			atomic.AddUint64(&ap.panics, 1)
+			pi.Log.Warnf("rtplugs Plug %s: Recovered from panic! Recover: %v", ap.name(), recovered)
+			pi.Log.Infof("rtplugs stacktrace from panic: \n %s\n", string(debug.Stack()))
+			err = fmt.Errorf("%w: %v", errPanic, recovered)
+		}
+	}()
+	f()
+	return nil
+}
+
+// call() runs f, giving up once timeout expires
+//
+// A panic in f is returned as an error.
+// When giving up, f keeps running in the background and its results should be ignored,
+// hence f must not share with the caller data it may modify (see approveRequest).
+func (ap *activePlug) call(timeout time.Duration, f func()) error {
+	if timeout <= 0 {
+		return ap.protect(f)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ap.protect(f)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		atomic.AddUint64(&ap.timeouts, 1)
+		return errTimeout
+	}
+}
+
+// init() initializes the plug using Initialize when the plug offers it, or Init otherwise
+func (ap *activePlug) init(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) (context.Context, error) {
+	c, err := ap.validateConfig(c)
+	if err != nil {
+		return ctx, fmt.Errorf("%w: %v", errInit, err)
+	}
+	ctxOut := ctx
+	initialize := func() { ctxOut = ap.plug.Init(ctx, c, serviceName, namespace, logger) }
+	if initializer, ok := ap.plug.(pi.Initializer); ok {
+		initialize = func() { ctxOut, err = initializer.Initialize(ctx, c, serviceName, namespace, logger) }
+	}
+	if failure := ap.protect(initialize); failure != nil {
+		err = failure
+	}
+	if err != nil {
+		return ctx, fmt.Errorf("%w: %v", errInit, err)
+	}
+	if ctxOut == nil {
+		ctxOut = ctx
+	}
+	return ctxOut, nil
+}
+
+func (ap *activePlug) approveRequest(req *http.Request) (*http.Request, error) {
+	if ap.initErr != nil {
+		return nil, ap.initErr
+	}
+	timeout := ap.policy().timeout
+	if timeout > 0 {
+		// a plug running out of time keeps running in the background,
+		// while req continues to the upstream - the plug gets a copy to modify.
+		// The copy shares the body, hence plugs touching the body must not set a timeout
+		req = req.Clone(req.Context())
+	}
+	var reqOut *http.Request
+	var err error
+	if failure := ap.call(timeout, func() { reqOut, err = ap.plug.ApproveRequest(req) }); failure != nil {
+		return nil, failure
+	}
+	return reqOut, err
+}
+
+func (ap *activePlug) approveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if ap.initErr != nil {
+		return nil, ap.initErr
+	}
+	timeout := ap.policy().timeout
+	if timeout > 0 {
+		// as in approveRequest, resp continues to the client when the plug runs out of time
+		req = req.Clone(req.Context())
+		resp = cloneResponse(resp)
+	}
+	var respOut *http.Response
+	var err error
+	if failure := ap.call(timeout, func() { respOut, err = ap.plug.ApproveResponse(req, resp) }); failure != nil {
+		return nil, failure
+	}
+	return respOut, err
+}
+
+// cloneResponse() returns a shallow copy of resp with its own headers, sharing the body
+func cloneResponse(resp *http.Response) *http.Response {
+	if resp == nil {
+		return nil
+	}
+	out := *resp
+	out.Header = resp.Header.Clone()
+	out.Trailer = resp.Trailer.Clone()
+	return &out
+}
+
+// reconfigure() applies config c to the plug in place
+//
+// The policy is updated from the reserved keys of c. When the plug implements
+// pluginterfaces.Reconfigurable, c is also pushed to the plug. Other plugs are
+// only reconfigured in place when the rest of their config is unchanged (see reconfigurePlug).
+func (ap *activePlug) reconfigure(c map[string]string) error {
+	ap.mu.RLock()
+	unchanged := equalConfig(ap.config, c)
+	ap.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	validated, err := ap.validateConfig(c)
+	if err != nil {
+		return err
+	}
+	policy := ap.parsePolicy(c)
+	if r, ok := ap.plug.(pi.Reconfigurable); ok {
+		if failure := ap.protect(func() { err = r.Reconfigure(validated) }); failure != nil {
+			return failure
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ap.mu.Lock()
+	ap.plugPolicy = policy
+	ap.config = c
+	ap.mu.Unlock()
+	pi.Log.Infof("rtplugs Plug %s: reconfigured with config %v", ap.name(), c)
+	return nil
+}
+
+// validateConfig() validates c against the schema of plugs implementing pluginterfaces.ConfigSchemer
+//
+// The returned config has the defaults declared by the schema set.
+// Unknown keys are logged, or rejected when the schema is strict. Reserved keys are never unknown.
+func (ap *activePlug) validateConfig(c map[string]string) (map[string]string, error) {
+	schemer, ok := ap.plug.(pi.ConfigSchemer)
+	if !ok {
+		return c, nil
+	}
+	var schema pi.ConfigSchema
+	if failure := ap.protect(func() { schema = schemer.ConfigSchema() }); failure != nil {
+		return nil, failure
+	}
+
+	var unknown []string
+	for _, key := range schema.Unknown(c) {
+		if !isReservedKey(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		if schema.Strict {
+			return nil, fmt.Errorf("unknown config keys %s", strings.Join(unknown, ","))
+		}
+		pi.Log.Warnf("rtplugs Plug %s: ignoring unknown config keys %s", ap.name(), strings.Join(unknown, ","))
+	}
+	return schema.Validate(c)
+}
+
+// plugConfigChanged() reports whether c changes config keys other than the keys reserved by rtplugs
+func (ap *activePlug) plugConfigChanged(c map[string]string) bool {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	return !equalConfig(plugConfig(ap.config), plugConfig(c))
+}
+
+// plugConfig() returns the keys of c not reserved by rtplugs
+func plugConfig(c map[string]string) map[string]string {
+	out := make(map[string]string, len(c))
+	for k, v := range c {
+		if !isReservedKey(k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func equalConfig(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func (ap *activePlug) shutdown() {
+	ap.protect(ap.plug.Shutdown)
+}
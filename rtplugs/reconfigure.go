@@ -0,0 +1,106 @@
+package rtplugs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// A ConfigParser parses the content of a config file into a plug list and the
+// config of each plug instance, as accepted by NewConfigrablePlugs
+type ConfigParser func(data []byte) (plugs []string, c map[string]map[string]string, err error)
+
+// Reconfigure() applies a new config to the active plugs
+//
+// c maps instance names to their config, as in NewConfigrablePlugs.
+// Keys reserved by rtplugs update the policy rtplugs applies when calling each plug,
+// and the chain is reordered when the priority of a plug changes.
+// The config is pushed to plugs implementing pluginterfaces.Reconfigurable, while
+// other plugs are replaced by a new instance initialized with the new config - the
+// old instance is shut down once the requests in flight using it complete.
+// A plug failing to reconfigure keeps its old config and policy.
+func (rt *RoundTrip) Reconfigure(c map[string]map[string]string) error {
+	rt.updateMu.Lock()
+	defer rt.updateMu.Unlock()
+
+	current := rt.currentPlugs()
+	next := make([]*activePlug, len(current))
+	replaced := false
+	var failed []string
+	for i, ap := range current {
+		var err error
+		if next[i], err = rt.reconfigurePlug(ap, c[ap.name()]); err != nil {
+			pi.Log.Warnf("rtplugs Plug %s: failed to reconfigure: %v", ap.name(), err)
+			failed = append(failed, ap.name())
+		}
+		replaced = replaced || next[i] != ap
+	}
+	// a new plug instance, or a changed priority, needs a new chain
+	if replaced || !plugsSorted(next) {
+		rt.replaceChain(next)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("rtplugs failed to reconfigure plugs %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// WatchFile() polls the file at path every interval and updates the plugs when its content changes
+//
+// The content is parsed using parse and applied using SetPlugs, such that plugs
+// added to the plug list are activated, removed plugs are shut down and the
+// remaining plugs are reconfigured.
+// Files updated by Kubernetes, such as the downward API annotations file, are
+// reread in full, hence changes are detected regardless of how the file was replaced.
+// New content is applied once it is unchanged over two consecutive polls, such
+// that a file caught mid-write is not applied. Content listing no plugs is ignored -
+// a watched file never clears the chain, use SetPlugs to deactivate all plugs.
+// Watching stops when the RoundTrip is closed.
+func (rt *RoundTrip) WatchFile(path string, interval time.Duration, parse ConfigParser) {
+	last, err := os.ReadFile(path)
+	if err != nil {
+		pi.Log.Infof("rtplugs can't read %s, watching for it to appear: %v", path, err)
+	}
+
+	var pending []byte
+	rt.every(interval, false, func() {
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.Equal(data, last) {
+			pending = nil
+			return
+		}
+		if pending == nil || !bytes.Equal(data, pending) {
+			// the file changed since the last poll, wait for it to settle
+			pending = data
+			return
+		}
+		last, pending = data, nil
+		rt.reload(path, data, parse)
+	})
+}
+
+// reload() applies the content of a watched file
+func (rt *RoundTrip) reload(path string, data []byte, parse ConfigParser) {
+	defer func() {
+		if r := recover(); r != nil {
+			pi.Log.Warnf("rtplugs Recovered from panic while reloading %s! Recover: %v", path, r)
+		}
+	}()
+	plugs, c, err := parse(data)
+	if err != nil {
+		pi.Log.Warnf("rtplugs ignoring the changes in %s: %v", path, err)
+		return
+	}
+	if len(plugs) == 0 {
+		pi.Log.Warnf("rtplugs ignoring the changes in %s: no plugs listed", path)
+		return
+	}
+	pi.Log.Infof("rtplugs reloading the config in %s", path)
+	if err := rt.SetPlugs(plugs, c); err != nil {
+		pi.Log.Warnf("%v", err)
+	}
+}
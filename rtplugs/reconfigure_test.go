@@ -0,0 +1,264 @@
+package rtplugs
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// reconfigPlug records the config it is reconfigured with
+type reconfigPlug struct {
+	fakePlug
+	err error
+	c   map[string]string
+}
+
+func (p *reconfigPlug) Reconfigure(c map[string]string) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.c = c
+	return nil
+}
+
+func TestReconfigure(t *testing.T) {
+	plain := newActivePlug(&fakePlug{name: "plain"}, "plain", nil)
+	good := &reconfigPlug{fakePlug: fakePlug{name: "good"}}
+	bad := &reconfigPlug{fakePlug: fakePlug{name: "bad"}, err: errors.New("fake error")}
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{
+		plain,
+		newActivePlug(good, "good", nil),
+		newActivePlug(bad, "bad", nil),
+	}}}
+
+	err := rt.Reconfigure(map[string]map[string]string{
+		"plain": {"mode": "monitor"},
+		"good":  {"mode": "monitor", "key": "value"},
+		"bad":   {"mode": "monitor"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("Reconfigure returned %v, expected bad to fail", err)
+	}
+	if !plain.policy().monitor {
+		t.Errorf("policy of a plug without Reconfigure was not updated")
+	}
+	if !rt.chain.plugs[1].policy().monitor || good.c["key"] != "value" {
+		t.Errorf("config was not pushed to the plug")
+	}
+	if rt.chain.plugs[2].policy().monitor {
+		t.Errorf("policy of a plug failing to reconfigure was updated")
+	}
+
+	// an unchanged config is not pushed again
+	good.c = nil
+	if err := rt.Reconfigure(map[string]map[string]string{"good": {"mode": "monitor", "key": "value"}}); err != nil {
+		t.Errorf("Reconfigure returned %v", err)
+	}
+	if good.c != nil {
+		t.Errorf("unchanged config was pushed to the plug")
+	}
+}
+
+// restartPlug records the config it is initialized with and whether it was shut down, and fails to initialize when the config has a fail key
+type restartPlug struct {
+	fakePlug
+	c    map[string]string
+	shut int32
+}
+
+func (p *restartPlug) Initialize(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) (context.Context, error) {
+	if c["fail"] != "" {
+		return ctx, errors.New("fake error")
+	}
+	p.c = c
+	return ctx, nil
+}
+
+func (p *restartPlug) Shutdown() {
+	atomic.StoreInt32(&p.shut, 1)
+}
+
+func init() {
+	pi.RegisterPlug(func() pi.RoundTripPlug {
+		return &restartPlug{fakePlug: fakePlug{name: "restartplug", version: "0.0.1"}}
+	})
+}
+
+func TestReconfigureNewInstance(t *testing.T) {
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"restartplug:gate"}, map[string]map[string]string{"gate": {"key": "one"}})
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil")
+	}
+	defer rt.Close()
+	old := rt.currentPlugs()[0]
+	oldPlug := old.plug.(*restartPlug)
+
+	// a policy change is applied in place
+	if err := rt.Reconfigure(map[string]map[string]string{"gate": {"key": "one", "mode": "monitor"}}); err != nil {
+		t.Errorf("Reconfigure returned %v", err)
+	}
+	if rt.currentPlugs()[0] != old || !old.policy().monitor {
+		t.Errorf("a policy change did not reconfigure the plug in place")
+	}
+
+	// a plug failing to initialize with the new config is kept
+	if err := rt.Reconfigure(map[string]map[string]string{"gate": {"key": "two", "fail": "yes"}}); err == nil {
+		t.Errorf("Reconfigure of a plug failing to initialize returned nil")
+	}
+	if rt.currentPlugs()[0] != old || old.config["key"] != "one" {
+		t.Errorf("a plug failing to initialize replaced the active plug")
+	}
+
+	// a config change activates a new instance, while the old instance drains
+	inflight := rt.acquire()
+	if err := rt.Reconfigure(map[string]map[string]string{"gate": {"key": "two"}}); err != nil {
+		t.Errorf("Reconfigure returned %v", err)
+	}
+	next := rt.currentPlugs()[0]
+	if next == old || next.plug.(*restartPlug).c["key"] != "two" || next.name() != "gate" {
+		t.Fatalf("the config change did not activate a new instance")
+	}
+	if next.policy().monitor || old.config["key"] != "one" {
+		t.Errorf("the new config was applied to the old instance")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&oldPlug.shut) != 0 {
+		t.Errorf("the old instance was shut down while a request was in flight")
+	}
+	inflight.release()
+	rt.retiring.Wait()
+	if atomic.LoadInt32(&oldPlug.shut) != 1 {
+		t.Errorf("the old instance was not shut down")
+	}
+
+	// SetPlugs also activates a new instance
+	if err := rt.SetPlugs([]string{"restartplug:gate"}, map[string]map[string]string{"gate": {"key": "three"}}); err != nil {
+		t.Errorf("SetPlugs returned %v", err)
+	}
+	if rt.currentPlugs()[0].plug.(*restartPlug).c["key"] != "three" {
+		t.Errorf("SetPlugs did not activate a new instance")
+	}
+}
+
+// parseTestConfig() parses lines of <instance>.<key>=<value>
+func parseTestConfig(data []byte) (plugs []string, c map[string]map[string]string, err error) {
+	c = make(map[string]map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		keyparts := strings.SplitN(kv[0], ".", 2)
+		if len(kv) != 2 || len(keyparts) != 2 {
+			return nil, nil, errors.New("illegal line " + line)
+		}
+		if _, ok := c[keyparts[0]]; !ok {
+			c[keyparts[0]] = make(map[string]string)
+			plugs = append(plugs, keyparts[0])
+		}
+		c[keyparts[0]][keyparts[1]] = kv[1]
+	}
+	return
+}
+
+// writeConfig() replaces the file at path atomically, as recommended for watched files
+func writeConfig(t *testing.T, path string, data string) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	writeConfig(t, path, "testgate.response=one\n")
+	_, c, _ := parseTestConfig([]byte("testgate.response=one\n"))
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"testgate"}, c)
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil\n")
+	}
+	rt.WatchFile(path, 5*time.Millisecond, parseTestConfig)
+
+	answer := func() string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Testgate-Hi", "value")
+		resp := httptest.NewRecorder().Result()
+		plugs := rt.currentPlugs()
+		if len(plugs) != 1 {
+			t.Fatalf("%d plugs are active, want 1", len(plugs))
+		}
+		plugs[0].approveResponse(req, resp)
+		return resp.Header.Get("X-Testgate-Bye")
+	}
+	if got := answer(); got != "one" {
+		t.Fatalf("answer %q before the change, want one", got)
+	}
+
+	// an illegal config is ignored
+	writeConfig(t, path, "illegal\n")
+	time.Sleep(50 * time.Millisecond)
+	if got := answer(); got != "one" {
+		t.Fatalf("answer %q after an illegal change, want one", got)
+	}
+
+	// content listing no plugs does not deactivate the chain
+	writeConfig(t, path, "")
+	time.Sleep(50 * time.Millisecond)
+	if got := answer(); got != "one" {
+		t.Fatalf("answer %q after an empty change, want one", got)
+	}
+
+	writeConfig(t, path, "testgate.response=two\ntestgate.mode=monitor\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for answer() != "two" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the plug was not reconfigured")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !rt.currentPlugs()[0].policy().monitor {
+		t.Errorf("the policy was not reconfigured")
+	}
+	rt.Close()
+}
+
+// A RoundTrip created without plugs protects the transport once plugs are activated
+func TestReconfigurableWithoutPlugs(t *testing.T) {
+	if _, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", nil, nil); rt != nil {
+		t.Errorf("NewConfigrablePlugs without plugs returned a RoundTrip")
+	}
+	_, rt := NewReconfigurablePlugs(context.Background(), nil, "myid", "myns", nil, nil)
+	if rt == nil {
+		t.Fatalf("NewReconfigurablePlugs without plugs returned nil")
+	}
+	defer rt.Close()
+	rt.Transport(new(FakeRoundTrip))
+	if resp, err := rt.RoundTrip(reqtest); resp == nil || err != nil {
+		t.Errorf("RoundTrip without plugs returned %v, %v", resp, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config")
+	rt.WatchFile(path, 5*time.Millisecond, parseTestConfig)
+	writeConfig(t, path, "testgate.response=one\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rt.currentPlugs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the plug was not activated")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if names := instanceNames(rt); len(names) != 1 || names[0] != "testgate" {
+		t.Errorf("activated %v", names)
+	}
+}
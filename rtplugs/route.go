@@ -0,0 +1,170 @@
+package rtplugs
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// Config keys reserved by rtplugs to scope a plug to the requests it matches
+//
+// Each key holds a comma separated list. A request matches a key when it matches
+// any entry of the list, and matches the plug when it matches all keys set.
+const (
+	matchPathKey   = "matchpath"   // path prefixes (e.g. "/api/upload") or globs (e.g. "/api/*/upload")
+	matchHostKey   = "matchhost"   // hosts or host globs (e.g. "*.example.com"), the port is ignored
+	matchMethodKey = "matchmethod" // methods (e.g. "POST,PUT")
+	matchHeaderKey = "matchheader" // names of headers present in the request (e.g. "Authorization")
+	skipPathKey    = "skippath"    // path prefixes or globs of requests the plug never sees (e.g. "/healthz")
+)
+
+// A route scopes a plug to the requests it matches, a nil route matches all requests
+type route struct {
+	paths     []string
+	hosts     []string
+	methods   []string
+	headers   []string
+	skipPaths []string
+}
+
+// parseRoute() returns the route set by the reserved keys of config c, or nil when none are set
+//
+// Illegal patterns are logged and ignored.
+func (ap *activePlug) parseRoute(c map[string]string) *route {
+	r := &route{
+		paths:     ap.parsePatterns(c, matchPathKey),
+		hosts:     ap.parsePatterns(c, matchHostKey),
+		methods:   parseList(c[matchMethodKey]),
+		headers:   parseList(c[matchHeaderKey]),
+		skipPaths: ap.parsePatterns(c, skipPathKey),
+	}
+	if len(r.paths)+len(r.hosts)+len(r.methods)+len(r.headers)+len(r.skipPaths) == 0 {
+		return nil
+	}
+	for i, host := range r.hosts {
+		r.hosts[i] = strings.ToLower(host)
+	}
+	for i, header := range r.headers {
+		r.headers[i] = http.CanonicalHeaderKey(header)
+	}
+	return r
+}
+
+func (ap *activePlug) parsePatterns(c map[string]string, key string) []string {
+	var patterns []string
+	for _, pattern := range parseList(c[key]) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			pi.Log.Warnf("rtplugs Plug %s: ignoring illegal %s %q", ap.name(), key, pattern)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// parseList() splits a comma separated list, dropping empty entries
+func parseList(v string) []string {
+	var list []string
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// matches() reports whether the plug should approve req and its response
+func (r *route) matches(req *http.Request) bool {
+	if r == nil {
+		return true
+	}
+	urlPath := cleanPath(req.URL.Path)
+	if matchPath(r.skipPaths, urlPath) {
+		return false
+	}
+	if len(r.paths) > 0 && !matchPath(r.paths, urlPath) {
+		return false
+	}
+	if len(r.hosts) > 0 && !matchHost(r.hosts, req.Host) {
+		return false
+	}
+	if len(r.methods) > 0 && !matchMethod(r.methods, req.Method) {
+		return false
+	}
+	if len(r.headers) > 0 && !matchHeader(r.headers, req.Header) {
+		return false
+	}
+	return true
+}
+
+// cleanPath() returns the canonical form of urlPath, as upstreams resolve it
+//
+// Matching the raw path would let "/healthz/../admin" skip a plug skipping "/healthz",
+// and "//api/upload" avoid a plug matching "/api/upload".
+// A trailing slash is kept, such that "/api/" matches a "/api/" prefix.
+func cleanPath(urlPath string) string {
+	if urlPath == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// matchPath() reports whether urlPath matches any of the path prefixes or globs
+//
+// A prefix matches whole path segments, e.g. "/api" matches "/api" and "/api/v1" but not "/apis".
+// A glob matches the whole path, e.g. "/api/*/upload" matches "/api/v1/upload".
+func matchPath(patterns []string, urlPath string) bool {
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[\\") {
+			if matched, _ := path.Match(pattern, urlPath); matched {
+				return true
+			}
+			continue
+		}
+		if !strings.HasPrefix(urlPath, pattern) {
+			continue
+		}
+		if len(urlPath) == len(pattern) || strings.HasSuffix(pattern, "/") || urlPath[len(pattern)] == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHeader(headers []string, header http.Header) bool {
+	for _, name := range headers {
+		if _, ok := header[name]; ok {
+			return true
+		}
+	}
+	return false
+}
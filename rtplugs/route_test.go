@@ -0,0 +1,95 @@
+package rtplugs
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		c      map[string]string
+		method string
+		target string
+		header string
+		want   bool
+	}{
+		{"no route", nil, "GET", "/any", "", true},
+		{"path prefix", map[string]string{"matchpath": "/api/upload"}, "GET", "/api/upload", "", true},
+		{"path below prefix", map[string]string{"matchpath": "/api/upload"}, "GET", "/api/upload/file", "", true},
+		{"path sharing prefix", map[string]string{"matchpath": "/api/upload"}, "GET", "/api/uploads", "", false},
+		{"path list", map[string]string{"matchpath": "/login, /api/upload"}, "GET", "/login", "", true},
+		{"path glob", map[string]string{"matchpath": "/api/*/upload"}, "GET", "/api/v1/upload", "", true},
+		{"path glob mismatch", map[string]string{"matchpath": "/api/*/upload"}, "GET", "/api/v1/download", "", false},
+		{"skip path", map[string]string{"skippath": "/healthz,/readyz"}, "GET", "/readyz", "", false},
+		{"skip path mismatch", map[string]string{"skippath": "/healthz"}, "GET", "/api", "", true},
+		{"skip overrides match", map[string]string{"matchpath": "/", "skippath": "/healthz"}, "GET", "/healthz", "", false},
+		{"skip path dot dot", map[string]string{"skippath": "/healthz"}, "GET", "/healthz/../admin", "", true},
+		{"skip path dot", map[string]string{"skippath": "/healthz"}, "GET", "/healthz/./", "", false},
+		{"path double slash", map[string]string{"matchpath": "/api/upload"}, "GET", "//api/upload", "", true},
+		{"path dot", map[string]string{"matchpath": "/api/upload"}, "GET", "/api/./upload", "", true},
+		{"path dot dot", map[string]string{"matchpath": "/api/upload"}, "GET", "/api/v1/../upload/file", "", true},
+		{"path trailing slash", map[string]string{"matchpath": "/api/"}, "GET", "/api//", "", true},
+		{"host", map[string]string{"matchhost": "example.com"}, "GET", "http://Example.com:8080/", "", true},
+		{"host glob", map[string]string{"matchhost": "*.example.com"}, "GET", "http://api.example.com/", "", true},
+		{"host mismatch", map[string]string{"matchhost": "*.example.com"}, "GET", "http://example.org/", "", false},
+		{"method", map[string]string{"matchmethod": "post,PUT"}, "POST", "/", "", true},
+		{"method mismatch", map[string]string{"matchmethod": "POST,PUT"}, "GET", "/", "", false},
+		{"header", map[string]string{"matchheader": "authorization"}, "GET", "/", "Authorization", true},
+		{"header missing", map[string]string{"matchheader": "Authorization"}, "GET", "/", "X-Other", false},
+		{"all keys", map[string]string{"matchpath": "/api", "matchmethod": "POST"}, "GET", "/api", "", false},
+		{"illegal pattern ignored", map[string]string{"matchpath": "/api/[", "matchmethod": "GET"}, "GET", "/other", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ap := newActivePlug(&fakePlug{name: "route"}, "route", tt.c)
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, "value")
+			}
+			if got := ap.policy().route.matches(req); got != tt.want {
+				t.Errorf("matches(%s %s) = %v, want %v", tt.method, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteScope(t *testing.T) {
+	var calls []string
+	var mu sync.Mutex
+	newPlug := func(name string, c map[string]string) *activePlug {
+		return newActivePlug(&orderPlug{fakePlug: fakePlug{name: name}, calls: &calls, mu: &mu}, name, c)
+	}
+	all := []*activePlug{
+		newPlug("auth", map[string]string{"skippath": "/healthz"}),
+		newPlug("inspect", map[string]string{"matchpath": "/api/upload", "matchmethod": "POST"}),
+	}
+	rt := &RoundTrip{chain: &chain{plugs: all}}
+	rt.Transport(new(FakeRoundTrip))
+
+	tests := []struct {
+		method string
+		target string
+		want   []string
+	}{
+		{"POST", "/api/upload", []string{"req:auth", "req:inspect", "resp:inspect", "resp:auth"}},
+		{"GET", "/api/upload", []string{"req:auth", "resp:auth"}},
+		{"GET", "/healthz", nil},
+	}
+	for _, tt := range tests {
+		calls = nil
+		if _, err := rt.RoundTrip(httptest.NewRequest(tt.method, tt.target, nil)); err != nil {
+			t.Fatalf("RoundTrip returned %v", err)
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("RoundTrip of %s %s called %v, want %v", tt.method, tt.target, calls, tt.want)
+		}
+	}
+
+	// the common case of all plugs matching does not copy the chain
+	if plugs := rt.chain.match(httptest.NewRequest("POST", "/api/upload", nil)); &plugs[0] != &all[0] {
+		t.Errorf("match copied the chain")
+	}
+}
@@ -5,12 +5,18 @@ package rtplugs
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opencensus.io/trace"
+
 	pi "github.com/IBM/go-security-plugs/pluginterfaces"
 )
 
@@ -26,31 +32,87 @@ import (
 // While `log` is an optional logger
 //
 type RoundTrip struct {
-	next           http.RoundTripper  // the next roundtripper
-	roundTripPlugs []pi.RoundTripPlug // list of activated plugs
+	next         http.RoundTripper // the next roundtripper
+	mu           sync.RWMutex      // guards chain
+	chain        *chain            // the activated plugs, replaced as a whole when plugs are added or removed
+	updateMu     sync.Mutex        // serializes changes to the activated plugs
+	retiring     sync.WaitGroup    // the goroutines shutting down removed plugs
+	ctx          context.Context   // the context used to initialize plugs
+	logger       pi.Logger         // the logger used to initialize plugs
+	serviceName  string            // the protected service
+	namespace    string            // the namespace of the protected service
+	decisionSink pi.DecisionSink   // a sink created by rtplugs, closed by Close()
+	stopMu       sync.Mutex        // guards stop
+	stop         chan struct{}     // closed by Close() to stop the background goroutines
+	background   sync.WaitGroup    // the goroutines watching config files and checking health
+	healthChecks sync.Once         // starts the health checks
+}
+
+// decide() reports a decision taken by ap about req to the trace span of the plug call,
+// the plug counters, the metrics and the pluginterfaces decision sink
+func (rt *RoundTrip) decide(span *trace.Span, ap *activePlug, req *http.Request, phase string, verdict string, reason error, elapsed time.Duration) {
+	endPlugSpan(span, verdict, reason)
+	ap.record(verdict, reason)
+	metrics.observePlug(ap.name(), phase, verdict, reason, elapsed)
+	if pi.CurrentDecisionSink() == nil {
+		return
+	}
+	d := pi.NewDecision(req, ap.name(), phase, verdict)
+	d.Latency = elapsed
+	if reason != nil {
+		d.Reason = reason.Error()
+	}
+	d.Service = rt.serviceName
+	d.Namespace = rt.namespace
+	pi.EmitDecision(d)
 }
 
-func (rt *RoundTrip) approveRequests(reqin *http.Request) (req *http.Request, err error) {
+func (rt *RoundTrip) approveRequests(ctx context.Context, plugs []*activePlug, reqin *http.Request) (req *http.Request, err error) {
 	req = reqin
-	for _, p := range rt.roundTripPlugs {
+	for _, ap := range plugs {
+		plugCtx, span := startPlugSpan(ctx, ap, pi.PhaseRequest)
 		start := time.Now()
-		req, err = p.ApproveRequest(req)
+		var reqOut *http.Request
+		reqOut, err = ap.approveRequest(plugRequest(plugCtx, req))
 		elapsed := time.Since(start)
+		if isFailure(err) {
+			if ap.skipOnFailure(err) {
+				pi.Log.Warnf("rtplugs Plug %s: ApproveRequest %v after %s, skipping plug", ap.name(), err, elapsed.String())
+				rt.decide(span, ap, req, pi.PhaseRequest, pi.VerdictSkip, err, elapsed)
+				err = nil
+				continue
+			}
+			pi.Log.Warnf("rtplugs Plug %s: ApproveRequest %v after %s, blocking", ap.name(), err, elapsed.String())
+		}
+		if err != nil && ap.policy().monitor {
+			atomic.AddUint64(&ap.wouldBlock, 1)
+			pi.Log.Infof("rtplugs Plug %s: ApproveRequest would block (monitor mode): %v", ap.name(), err)
+			rt.decide(span, ap, req, pi.PhaseRequest, pi.VerdictWouldBlock, err, elapsed)
+			err = nil
+			continue
+		}
 		if err != nil {
-			pi.Log.Infof("rtplugs Plug %s: ApproveRequest returned an error %v", p.PlugName(), err)
+			pi.Log.Infof("rtplugs Plug %s: ApproveRequest returned an error %v", ap.name(), err)
+			rt.decide(span, ap, req, pi.PhaseRequest, pi.VerdictBlock, err, elapsed)
 			req = nil
 			return
 		}
-		pi.Log.Debugf("rtplugs Plug %s: ApproveRequest took %s", p.PlugName(), elapsed.String())
+		rt.decide(span, ap, req, pi.PhaseRequest, pi.VerdictAllow, nil, elapsed)
+		req = reqOut
+		pi.Log.Debugf("rtplugs Plug %s: ApproveRequest took %s", ap.name(), elapsed.String())
 	}
 	return
 }
 
-func (rt *RoundTrip) nextRoundTrip(req *http.Request) (resp *http.Response, err error) {
+func (rt *RoundTrip) nextRoundTrip(ctx context.Context, req *http.Request) (resp *http.Response, err error) {
+	ctx, span := trace.StartSpan(ctx, "rtplugs.nextRoundTrip")
+	defer span.End()
 	start := time.Now()
-	resp, err = rt.next.RoundTrip(req)
+	resp, err = rt.next.RoundTrip(withSpan(ctx, req))
 	elapsed := time.Since(start)
+	metrics.observeUpstream(elapsed)
 	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnavailable, Message: err.Error()})
 		pi.Log.Infof("rtplugs nextRoundTrip (i.e. DefaultTransport) returned an error %v", err)
 		resp = nil
 		return
@@ -59,23 +121,78 @@ func (rt *RoundTrip) nextRoundTrip(req *http.Request) (resp *http.Response, err
 	return
 }
 
-func (rt *RoundTrip) approveResponse(req *http.Request, respIn *http.Response) (resp *http.Response, err error) {
+func (rt *RoundTrip) approveResponse(ctx context.Context, plugs []*activePlug, req *http.Request, respIn *http.Response) (resp *http.Response, err error) {
 	resp = respIn
-	for _, p := range rt.roundTripPlugs {
+	// like a middleware stack, the first plug approving the request is the last to approve the response
+	for i := len(plugs) - 1; i >= 0; i-- {
+		ap := plugs[i]
+		plugCtx, span := startPlugSpan(ctx, ap, pi.PhaseResponse)
 		start := time.Now()
-		resp, err = p.ApproveResponse(req, resp)
+		current := resp
+		resp, err = ap.approveResponse(plugRequest(plugCtx, req), resp)
 		elapsed := time.Since(start)
+		if isFailure(err) {
+			if ap.skipOnFailure(err) {
+				pi.Log.Warnf("rtplugs Plug %s: ApproveResponse %v after %s, skipping plug", ap.name(), err, elapsed.String())
+				rt.decide(span, ap, req, pi.PhaseResponse, pi.VerdictSkip, err, elapsed)
+				resp = current
+				err = nil
+				continue
+			}
+			pi.Log.Warnf("rtplugs Plug %s: ApproveResponse %v after %s, blocking", ap.name(), err, elapsed.String())
+		}
+		if err != nil && ap.policy().monitor {
+			atomic.AddUint64(&ap.wouldBlock, 1)
+			pi.Log.Infof("rtplugs Plug %s: ApproveResponse would block (monitor mode): %v", ap.name(), err)
+			rt.decide(span, ap, req, pi.PhaseResponse, pi.VerdictWouldBlock, err, elapsed)
+			resp = current
+			err = nil
+			continue
+		}
 		if err != nil {
-			pi.Log.Infof("rtplugs Plug %s: ApproveResponse returned an error %v", p.PlugName(), err)
+			pi.Log.Infof("rtplugs Plug %s: ApproveResponse returned an error %v", ap.name(), err)
+			rt.decide(span, ap, req, pi.PhaseResponse, pi.VerdictBlock, err, elapsed)
+			// the response will never be delivered, release the connection to the server
+			if current != nil && current.Body != nil {
+				current.Body.Close()
+			}
 			resp = nil
 			return
 		}
-		pi.Log.Debugf("rtplugs Plug %s: ApproveResponse took %s", p.PlugName(), elapsed.String())
+		rt.decide(span, ap, req, pi.PhaseResponse, pi.VerdictAllow, nil, elapsed)
+		pi.Log.Debugf("rtplugs Plug %s: ApproveResponse took %s", ap.name(), elapsed.String())
 	}
 	return
 }
 
-func (rt *RoundTrip) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+// blockResponse() builds the response sent to the client when a plug returns a BlockError
+func blockResponse(req *http.Request, blockErr *pi.BlockError) *http.Response {
+	status := blockErr.Status()
+	header := make(http.Header)
+	for k, v := range blockErr.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	if blockErr.Body != "" && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(blockErr.Body)),
+		ContentLength: int64(len(blockErr.Body)),
+		Request:       req,
+	}
+}
+
+// RoundTrip() screens req and the response returned for it using the activated plugs
+//
+// A plug blocking using a pluginterfaces.BlockError results in a response built from the BlockError
+// Any other error or panic results in an error (and the reverseproxy sending a 502 response code)
+func (rt *RoundTrip) RoundTrip(reqin *http.Request) (resp *http.Response, err error) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			pi.Log.Warnf("rtplus Recovered from panic during RoundTrip! Recover: %v\n", recovered)
@@ -85,11 +202,31 @@ func (rt *RoundTrip) RoundTrip(req *http.Request) (resp *http.Response, err erro
 		}
 	}()
 
-	if req, err = rt.approveRequests(req); err == nil {
-		if resp, err = rt.nextRoundTrip(req); err == nil {
-			resp, err = rt.approveResponse(req, resp)
+	c := rt.acquire()
+	defer c.release()
+
+	ctx, span := startRoundTripSpan(reqin)
+	defer span.End()
+
+	// the plugs approving the request also approve its response
+	plugs := c.match(reqin)
+	var req *http.Request
+	reqCtx, reqSpan := trace.StartSpan(ctx, "rtplugs.approveRequests")
+	req, err = rt.approveRequests(reqCtx, plugs, reqin)
+	reqSpan.End()
+	if err == nil {
+		if resp, err = rt.nextRoundTrip(ctx, req); err == nil {
+			respCtx, respSpan := trace.StartSpan(ctx, "rtplugs.approveResponse")
+			resp, err = rt.approveResponse(respCtx, plugs, req, resp)
+			respSpan.End()
 		}
 	}
+
+	var blockErr *pi.BlockError
+	if errors.As(err, &blockErr) {
+		resp = blockResponse(reqin, blockErr)
+		err = nil
+	}
 	return
 }
 
@@ -97,39 +234,19 @@ func (rt *RoundTrip) RoundTrip(req *http.Request) (resp *http.Response, err erro
 //
 // env RTPLUGS defines a comma seperated list of plug names
 // A typical RTPLUGS value would be "rtplug,wsplug"
+// A plug may be activated more than once using an alias, e.g. "rtgate:gate1,rtgate:gate2"
+// env RTPLUGS_CONFIG defines an optional YAML or JSON config file used instead of RTPLUGS (see ChainConfig)
 // The plugs may be added statically (using imports) or dynmaicaly (.so files)
+// env RTPLUGS_DIR defines an optional directory from which .so files are loaded
+// env RTPLUGS_DECISIONS defines an optional comma seperated list of decision sinks (see NewDecisionSinks)
+//
+// New logs any error and returns nil when the plugs can't be activated,
+// use NewWithOptions to handle errors
 func New(logger pi.Logger) (rt *RoundTrip) {
-	pluglist := os.Getenv("RTPLUGS")
-	if pluglist == "" {
-		return
-	}
-
-	comma := func(c rune) bool {
-		return c == ','
-	}
-	plugs := strings.FieldsFunc(pluglist, comma)
-
-	namespace := os.Getenv("NAMESPACE")
-	if namespace == "" {
-		dat, err := os.ReadFile("/etc/podinfo/namespace")
-		if err == nil {
-			namespace = string(dat)
-		}
-	}
-	svcname := os.Getenv("SERVICENAME")
-	if svcname == "" {
-		dat, err := os.ReadFile("/etc/podinfo/servicename")
-		if err == nil {
-			svcname = string(dat)
-		}
-	}
-
-	if namespace == "" || svcname == "" {
-		// mandatory
-		panic("Can't find mandatory parameter namespace")
+	rt, err := NewWithOptions(WithLogger(logger))
+	if err != nil {
+		pi.Log.Errorf("%v", err)
 	}
-
-	_, rt = NewConfigrablePlugs(context.Background(), logger, svcname, namespace, plugs, nil)
 	return rt
 }
 
@@ -140,9 +257,32 @@ func New(logger pi.Logger) (rt *RoundTrip) {
 //
 // Once the existing RoundTripper is wrapped, data flowing to and from the
 // existing RoundTripper will be screened using the security plugs
+//
+// The config of each plug may also include keys reserved by rtplugs, setting the
+// policy rtplugs applies when calling the plug (see README.md)
 func NewConfigrablePlugs(ctxin context.Context, logger pi.Logger, svcname string, namespace string, plugs []string, c map[string]map[string]string) (ctxout context.Context, rt *RoundTrip) {
+	// failures are logged and the failing plugs are skipped
+	ctxout, rt, _ = newRoundTrip(ctxin, logger, svcname, namespace, plugs, c, false)
+	return
+}
+
+// NewReconfigurablePlugs() activates plugs as NewConfigrablePlugs does, but returns a
+// RoundTrip even when no plug was activated
+//
+// Plugs activated later, using SetPlugs or WatchFile, protect the wrapped RoundTripper
+// without restarting the application. Until then, requests pass through unchanged.
+func NewReconfigurablePlugs(ctxin context.Context, logger pi.Logger, svcname string, namespace string, plugs []string, c map[string]map[string]string) (ctxout context.Context, rt *RoundTrip) {
+	ctxout, rt, _ = newRoundTrip(ctxin, logger, svcname, namespace, plugs, c, true)
+	return
+}
+
+// newRoundTrip() activates plugs, returning an error describing the plugs that failed to activate
+//
+// A nil RoundTrip is returned when no plug was activated, unless keepEmpty is set.
+func newRoundTrip(ctxin context.Context, logger pi.Logger, svcname string, namespace string, plugs []string, c map[string]map[string]string, keepEmpty bool) (ctxout context.Context, rt *RoundTrip, err error) {
+	ctxout = ctxin
 	//skip for an empty pluglist
-	if len(plugs) == 0 {
+	if len(plugs) == 0 && !keepEmpty {
 		return
 	}
 
@@ -151,43 +291,88 @@ func NewConfigrablePlugs(ctxin context.Context, logger pi.Logger, svcname string
 		pi.Log = logger
 	}
 
+	// Load any dynamic plugs
+	if dir := os.Getenv("RTPLUGS_DIR"); dir != "" {
+		if err := LoadPlugs(dir); err != nil {
+			pi.Log.Warnf("rtplugs %v", err)
+		}
+	}
+
 	// Never panic the caller app from here
 	defer func() {
 		if r := recover(); r != nil {
 			pi.Log.Warnf("rtplugs Recovered from panic during rtplugs.New()! One or more plugs may be skipped. Recover: %v", r)
+			err = fmt.Errorf("rtplugs paniced while activating plugs: %v", r)
 		}
-		if (rt != nil) && len(rt.roundTripPlugs) == 0 {
+		if (rt != nil) && (rt.chain == nil || (len(rt.chain.plugs) == 0 && !keepEmpty)) {
 			rt = nil
 		}
 	}()
 
-	ctxout = ctxin
-	for _, plugName := range plugs {
-		var foundPlug bool
-		for _, p := range pi.RoundTripPlugs {
-			if p.PlugName() == plugName {
-				foundPlug = true
-				var plugConfig map[string]string
-				if c != nil {
-					plugConfig = c[plugName]
-				}
-				// found a loaded plug, lets activate it
-				pi.Log.Infof("Activating Plug %s with config %v", plugName, plugConfig)
-				ctxout = p.Init(ctxout, plugConfig, svcname, namespace, logger)
-				if rt == nil {
-					rt = new(RoundTrip)
-				}
-				rt.roundTripPlugs = append(rt.roundTripPlugs, p)
-				break
-			}
+	rt = &RoundTrip{serviceName: svcname, namespace: namespace, ctx: ctxin, logger: logger}
+	var active []*activePlug
+	var failed []string
+	for _, plugEntry := range plugs {
+		_, instanceName := parsePlugEntry(plugEntry)
+		if findPlug(active, instanceName) != nil {
+			pi.Log.Warnf("rtplugs Plug %s is already active, use an alias to activate it again", instanceName)
+			failed = append(failed, fmt.Sprintf("%s: already active", instanceName))
+			continue
 		}
-		if !foundPlug {
-			pi.Log.Infof("Plug %s is not supported by this image. Consult your IT", plugName)
+		var plugConfig map[string]string
+		if c != nil {
+			plugConfig = c[instanceName]
+		}
+		var ap *activePlug
+		var activateErr error
+		if ctxout, ap, activateErr = rt.activatePlug(ctxout, plugEntry, plugConfig); activateErr != nil {
+			pi.Log.Warnf("rtplugs Plug %s: %v, skipping plug", instanceName, activateErr)
+			failed = append(failed, fmt.Sprintf("%s: %v", instanceName, activateErr))
+			continue
+		}
+		if ap.initErr != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v, the plug blocks all requests", instanceName, ap.initErr))
+		}
+		active = append(active, ap)
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("rtplugs failed to activate plugs: %s", strings.Join(failed, "; "))
+	}
+	sortPlugs(active)
+	rt.chain = &chain{plugs: active}
+	if len(active) == 0 && !keepEmpty {
+		return
+	}
+	rt.startHealthChecks(active)
+	// Report decisions to the sinks in RTPLUGS_DECISIONS, unless the caller set its own sink
+	if spec := os.Getenv("RTPLUGS_DECISIONS"); spec != "" && pi.CurrentDecisionSink() == nil {
+		if sink, sinkErr := NewDecisionSinks(spec); sinkErr != nil {
+			pi.Log.Warnf("rtplugs can't report decisions: %v", sinkErr)
+		} else if pi.ReplaceDecisionSink(nil, sink) {
+			rt.decisionSink = sink
+		} else {
+			// the caller set its own sink meanwhile
+			sink.Close()
 		}
+	}
+	return
+}
 
+// parsePlugEntry() splits an entry of the plug list into the plug name and the instance name
+//
+// An entry is either a plug name such as "rtgate" or a plug name followed by an
+// instance alias such as "rtgate:gate1". The instance name is the alias if one is given,
+// or the plug name otherwise. The config of each instance is looked up by its instance name.
+func parsePlugEntry(entry string) (plugName string, instanceName string) {
+	entry = strings.TrimSpace(entry)
+	if i := strings.Index(entry, ":"); i >= 0 {
+		plugName = entry[:i]
+		instanceName = entry[i+1:]
+	} else {
+		plugName = entry
 	}
-	for _, p := range rt.roundTripPlugs {
-		pi.Log.Debugf("Plug %s version %s is active for service %s namespace %s", p.PlugName(), p.PlugVersion(), svcname, namespace)
+	if instanceName == "" {
+		instanceName = plugName
 	}
 	return
 }
@@ -209,6 +394,7 @@ func (rt *RoundTrip) Transport(t http.RoundTripper) http.RoundTripper {
 //
 // Note that Close does not unload the .so files,
 // instead, it informs all loaded plugs to gracefully shutdown and cleanup
+// once the requests in flight complete
 func (rt *RoundTrip) Close() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -216,8 +402,54 @@ func (rt *RoundTrip) Close() {
 		}
 		pi.Log.Sync()
 	}()
-	for _, p := range rt.roundTripPlugs {
-		p.Shutdown()
+	rt.stopBackground()
+	rt.updateMu.Lock()
+	rt.replaceChain(nil)
+	rt.updateMu.Unlock()
+	rt.retiring.Wait()
+	if rt.decisionSink != nil {
+		pi.ReplaceDecisionSink(rt.decisionSink, nil)
+		rt.decisionSink.Close()
+		rt.decisionSink = nil
+	}
+}
+
+// every() calls f every interval in the background, until the RoundTrip is closed
+//
+// When now is set, f is also called right away, in the background.
+func (rt *RoundTrip) every(interval time.Duration, now bool, f func()) {
+	rt.stopMu.Lock()
+	defer rt.stopMu.Unlock()
+	if rt.stop == nil {
+		rt.stop = make(chan struct{})
+	}
+	stop := rt.stop
+	rt.background.Add(1)
+	go func() {
+		defer rt.background.Done()
+		if now {
+			f()
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				f()
+			}
+		}
+	}()
+}
+
+// stopBackground() stops the background goroutines and waits for them to return
+func (rt *RoundTrip) stopBackground() {
+	rt.stopMu.Lock()
+	if rt.stop != nil {
+		close(rt.stop)
+		rt.stop = nil
 	}
-	rt.roundTripPlugs = []pi.RoundTripPlug{}
+	rt.stopMu.Unlock()
+	rt.background.Wait()
 }
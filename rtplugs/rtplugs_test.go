@@ -2,17 +2,21 @@ package rtplugs
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	goLog "log"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	pi "github.com/IBM/go-security-plugs/pluginterfaces"
 
 	_ "github.com/IBM/go-security-plugs/plugs/rtgate"
+	_ "github.com/IBM/go-security-plugs/plugs/testgate"
 )
 
 type countLog int
@@ -72,6 +76,10 @@ func init() {
 	emptytestconfig = ""
 	falsetestconfig = "noplug"
 
+	pi.RegisterPlug(func() pi.RoundTripPlug {
+		return &fakePlug{name: "slowplug", version: "0.0.1", delay: 50 * time.Millisecond}
+	})
+
 	reqtest, _ = http.NewRequest("GET", "http://10.0.0.1/", nil)
 	reqtestBlock, _ = http.NewRequest("GET", "http://10.0.0.1/", nil)
 	reqtestBlock.Header.Set("X-Block-Async", "0.01s")
@@ -79,7 +87,8 @@ func init() {
 	//reqtest.URL = u
 	//reqtest.Header.Set("name", "value")
 	resptest = &http.Response{
-		Body: ioutil.NopCloser(bytes.NewBufferString("Hello World")),
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(bytes.NewBufferString("Hello World")),
 	}
 
 	resptest.Request = reqtest
@@ -130,6 +139,35 @@ func (rt *FakeRoundTrip) RoundTrip(req *http.Request) (resp *http.Response, err
 	return resptest, nil
 }
 
+type fakePlug struct {
+	name    string
+	version string
+	reqErr  error
+	respErr error
+	delay   time.Duration
+}
+
+func (p *fakePlug) Init(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) context.Context {
+	return ctx
+}
+func (p *fakePlug) Shutdown()           {}
+func (p *fakePlug) PlugName() string    { return p.name }
+func (p *fakePlug) PlugVersion() string { return p.version }
+func (p *fakePlug) ApproveRequest(req *http.Request) (*http.Request, error) {
+	time.Sleep(p.delay)
+	if p.reqErr != nil {
+		return nil, p.reqErr
+	}
+	return req, nil
+}
+func (p *fakePlug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	time.Sleep(p.delay)
+	if p.respErr != nil {
+		return nil, p.respErr
+	}
+	return resp, nil
+}
+
 func TestMain(m *testing.M) {
 	testlog = 0
 	InitializeEnv("", "", "")
@@ -292,10 +330,28 @@ func TestLoadPlugs(t *testing.T) {
 
 	pi.Log = log
 
+	// by default, a plug failing to initialize blocks all requests
 	InitializeEnv("RT_GATE_PANIC_INIT")
-	if rt = New(nil); rt != nil {
+	if rt = New(nil); rt == nil {
+		t.Fatalf("LoadPlugs did not expect nil\n")
+	}
+	rt.Transport(new(FakeRoundTrip))
+	if resp, err := rt.RoundTrip(reqtest); err == nil || resp != nil {
+		t.Errorf("RoundTrip expected an error from a plug that failed to initialize\n")
+	}
+	rt.Close()
+
+	// unless the plug fails open
+	c := map[string]map[string]string{"rtgate": {"onfailure": "open"}}
+	if _, rt = NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"rtgate"}, c); rt != nil {
 		t.Errorf("LoadPlugs expected nil\n")
 	}
+
+	// remaining plugs are still activated
+	c = map[string]map[string]string{"rtgate": {"onfailure": "open"}}
+	if _, rt = NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"rtgate", "slowplug"}, c); rt == nil || len(rt.chain.plugs) != 1 {
+		t.Errorf("LoadPlugs expected slowplug to be activated\n")
+	}
 }
 
 func TestDefaultLog(t *testing.T) {
@@ -304,3 +360,288 @@ func TestDefaultLog(t *testing.T) {
 	defaultLog.Warnf("Warnf")
 	defaultLog.Errorf("Errorf")
 }
+
+func TestBlockError(t *testing.T) {
+	unauthorized := pi.NewBlockError(http.StatusUnauthorized, "no credentials")
+	unauthorized.Header.Set("WWW-Authenticate", "Basic")
+	tooMany := &pi.BlockError{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"10"}}, Body: "slow down"}
+	tests := []struct {
+		name       string
+		plug       *fakePlug
+		wantStatus int
+		wantHeader string
+		wantBody   string
+	}{
+		{"request default", &fakePlug{name: "block", reqErr: &pi.BlockError{}}, http.StatusForbidden, "", ""},
+		{"request unauthorized", &fakePlug{name: "block", reqErr: unauthorized}, http.StatusUnauthorized, "WWW-Authenticate", ""},
+		{"response too many", &fakePlug{name: "block", respErr: tooMany}, http.StatusTooManyRequests, "Retry-After", "slow down"},
+		{"response wrapped", &fakePlug{name: "block", respErr: fmt.Errorf("wrapped: %w", tooMany)}, http.StatusTooManyRequests, "Retry-After", "slow down"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: tt.plug}}}}
+			rt.Transport(new(FakeRoundTrip))
+			resp, err := rt.RoundTrip(reqtest)
+			if err != nil {
+				t.Fatalf("RoundTrip returned err %v\n", err)
+			}
+			if resp == nil || resp.StatusCode != tt.wantStatus {
+				t.Fatalf("RoundTrip returned resp %v, want status %d\n", resp, tt.wantStatus)
+			}
+			if tt.wantHeader != "" && resp.Header.Get(tt.wantHeader) == "" {
+				t.Errorf("RoundTrip resp is missing header %s\n", tt.wantHeader)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("RoundTrip resp body is %q, want %q\n", body, tt.wantBody)
+			}
+			if resp.Request != reqtest {
+				t.Errorf("RoundTrip resp does not point to the request\n")
+			}
+		})
+	}
+
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: &fakePlug{name: "err", reqErr: errors.New("fake error")}}}}}
+	rt.Transport(new(FakeRoundTrip))
+	if resp, err := rt.RoundTrip(reqtest); err == nil || resp != nil {
+		t.Errorf("RoundTrip expected an error for a plain error\n")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		wantErr bool
+	}{
+		{"no timeout", nil, false},
+		{"within timeout", map[string]string{"timeout": "1s"}, false},
+		{"timeout closed", map[string]string{"timeout": "10ms"}, true},
+		{"timeout explicitly closed", map[string]string{"timeout": "10ms", "ontimeout": "closed"}, true},
+		{"timeout open", map[string]string{"timeout": "10ms", "ontimeout": "open"}, false},
+		{"illegal timeout", map[string]string{"timeout": "soon"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := map[string]map[string]string{"slowplug": tt.config}
+			_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"slowplug"}, c)
+			if rt == nil {
+				t.Fatalf("NewConfigrablePlugs returned nil\n")
+			}
+			defer rt.Close()
+			rt.Transport(new(FakeRoundTrip))
+			resp, err := rt.RoundTrip(reqtest)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RoundTrip returned err %v, wantErr %v\n", err, tt.wantErr)
+			}
+			if (resp == nil) != tt.wantErr {
+				t.Errorf("RoundTrip returned resp %v, wantErr %v\n", resp, tt.wantErr)
+			}
+			timeouts := atomic.LoadUint64(&rt.chain.plugs[0].timeouts)
+			if tt.config["timeout"] == "10ms" && timeouts == 0 {
+				t.Errorf("timeout was not recorded\n")
+			}
+		})
+	}
+
+	// a plug panicking within its timeout fails
+	ap := &activePlug{plug: &fakePlug{name: "panic"}, plugPolicy: plugPolicy{timeout: time.Second}}
+	if err := ap.call(time.Second, func() { panic("fake panic") }); !errors.Is(err, errPanic) {
+		t.Errorf("call returned %v, expected a panic\n", err)
+	}
+}
+
+// lateWriter modifies the headers it receives after running out of time
+type lateWriter struct {
+	fakePlug
+	done chan bool
+}
+
+func (p *lateWriter) ApproveRequest(req *http.Request) (*http.Request, error) {
+	time.Sleep(p.delay)
+	req.Header.Set("X-Late", "request")
+	p.done <- true
+	return req, nil
+}
+
+func (p *lateWriter) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	time.Sleep(p.delay)
+	resp.Header.Set("X-Late", "response")
+	p.done <- true
+	return resp, nil
+}
+
+// A plug running out of time can't modify the request sent upstream or the response sent to the client
+func TestTimeoutIsolation(t *testing.T) {
+	plug := &lateWriter{fakePlug: fakePlug{name: "late", delay: 20 * time.Millisecond}, done: make(chan bool, 2)}
+	ap := &activePlug{plug: plug, plugPolicy: plugPolicy{timeout: time.Millisecond, timeoutOpen: true}}
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/", nil)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+
+	if _, err := ap.approveRequest(req); !errors.Is(err, errTimeout) {
+		t.Fatalf("approveRequest returned %v, expected a timeout", err)
+	}
+	if _, err := ap.approveResponse(req, resp); !errors.Is(err, errTimeout) {
+		t.Fatalf("approveResponse returned %v, expected a timeout", err)
+	}
+	// the request and response proceed while the plug is still running
+	for i := 0; i < 10; i++ {
+		req.Header.Set("X-Upstream", "value")
+		resp.Header.Set("X-Upstream", "value")
+		time.Sleep(time.Millisecond)
+	}
+	<-plug.done
+	<-plug.done
+	if req.Header.Get("X-Late") != "" || resp.Header.Get("X-Late") != "" {
+		t.Errorf("a plug modified headers after running out of time")
+	}
+}
+
+func TestOnFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		config  map[string]string
+		wantErr bool
+	}{
+		{"panic req closed", "RT_GATE_PANIC_REQ", nil, true},
+		{"panic req open", "RT_GATE_PANIC_REQ", map[string]string{"onfailure": "open"}, false},
+		{"panic resp closed", "RT_GATE_PANIC_RESP", map[string]string{"onfailure": "closed"}, true},
+		{"panic resp open", "RT_GATE_PANIC_RESP", map[string]string{"onfailure": "open"}, false},
+		{"panic ontimeout open", "RT_GATE_PANIC_REQ", map[string]string{"ontimeout": "open"}, true},
+		{"illegal policy", "RT_GATE_PANIC_REQ", map[string]string{"onfailure": "maybe"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitializeEnv(tt.env)
+			defer InitializeEnv()
+			c := map[string]map[string]string{"rtgate": tt.config}
+			_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"rtgate"}, c)
+			if rt == nil {
+				t.Fatalf("NewConfigrablePlugs returned nil\n")
+			}
+			defer rt.Close()
+			rt.Transport(new(FakeRoundTrip))
+			resp, err := rt.RoundTrip(reqtest)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RoundTrip returned err %v, wantErr %v\n", err, tt.wantErr)
+			}
+			if (resp == nil) != tt.wantErr {
+				t.Errorf("RoundTrip returned resp %v, wantErr %v\n", resp, tt.wantErr)
+			}
+			if atomic.LoadUint64(&rt.chain.plugs[0].panics) == 0 {
+				t.Errorf("panic was not recorded\n")
+			}
+		})
+	}
+
+	// a timeout follows onfailure unless ontimeout is set
+	ap := newActivePlug(&fakePlug{name: "policy"}, "policy", map[string]string{"onfailure": "open"})
+	if !ap.skipOnFailure(errTimeout) || !ap.skipOnFailure(errPanic) {
+		t.Errorf("expected the plug to fail open\n")
+	}
+	ap = newActivePlug(&fakePlug{name: "policy"}, "policy", map[string]string{"onfailure": "open", "ontimeout": "closed"})
+	if ap.skipOnFailure(errTimeout) || !ap.skipOnFailure(errPanic) {
+		t.Errorf("expected the plug to fail closed on timeout only\n")
+	}
+}
+
+func TestMonitorMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  []string
+		mode    string
+		wantErr bool
+	}{
+		{"enforce req", []string{"", "fake error"}, "enforce", true},
+		{"monitor req", []string{"", "fake error"}, "monitor", false},
+		{"enforce resp", []string{"", "", "fake error"}, "", true},
+		{"monitor resp", []string{"", "", "fake error"}, "monitor", false},
+		{"monitor panic", []string{"RT_GATE_PANIC_REQ"}, "monitor", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitializeEnv(tt.params...)
+			defer InitializeEnv()
+			c := map[string]map[string]string{"rtgate": {"mode": tt.mode}}
+			_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", []string{"rtgate"}, c)
+			if rt == nil {
+				t.Fatalf("NewConfigrablePlugs returned nil\n")
+			}
+			defer rt.Close()
+			rt.Transport(new(FakeRoundTrip))
+			resp, err := rt.RoundTrip(reqtest)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RoundTrip returned err %v, wantErr %v\n", err, tt.wantErr)
+			}
+			if !tt.wantErr && resp != resptest {
+				t.Errorf("RoundTrip did not return the response unmodified\n")
+			}
+		})
+	}
+
+	// block decisions are recorded
+	ap := &activePlug{plug: &fakePlug{name: "block", reqErr: &pi.BlockError{}}, plugPolicy: plugPolicy{monitor: true}}
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{ap}}}
+	rt.Transport(new(FakeRoundTrip))
+	if resp, err := rt.RoundTrip(reqtest); err != nil || resp != resptest {
+		t.Errorf("RoundTrip blocked in monitor mode\n")
+	}
+	if atomic.LoadUint64(&ap.wouldBlock) != 1 {
+		t.Errorf("RoundTrip did not record the block decision\n")
+	}
+}
+
+func TestPlugInstances(t *testing.T) {
+	plugs := []string{"testgate:first", "testgate:second", "testgate:second", "testgate"}
+	c := map[string]map[string]string{
+		"first":  {"response": "one"},
+		"second": {"response": "two"},
+	}
+	_, rt := NewConfigrablePlugs(context.Background(), nil, "myid", "myns", plugs, c)
+	if rt == nil {
+		t.Fatalf("NewConfigrablePlugs returned nil\n")
+	}
+	defer rt.Close()
+	if len(rt.chain.plugs) != 3 {
+		t.Fatalf("expected 3 plug instances, found %d\n", len(rt.chain.plugs))
+	}
+	if rt.chain.plugs[0].plug == rt.chain.plugs[1].plug {
+		t.Errorf("plug instances share the same plug\n")
+	}
+
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/", nil)
+	req.Header.Set("X-Testgate-Hi", "true")
+	rt.Transport(new(FakeRoundTrip))
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned err %v\n", err)
+	}
+	got := resp.Header.Values("X-Testgate-Bye")
+	resp.Header.Del("X-Testgate-Bye")
+	// responses are approved in reverse order
+	if len(got) != 3 || got[0] != "CU" || got[1] != "two" || got[2] != "one" {
+		t.Errorf("expected each instance to use its own config, got %v\n", got)
+	}
+}
+
+func TestParsePlugEntry(t *testing.T) {
+	tests := []struct {
+		entry        string
+		wantPlug     string
+		wantInstance string
+	}{
+		{"rtgate", "rtgate", "rtgate"},
+		{" rtgate ", "rtgate", "rtgate"},
+		{"rtgate:gate1", "rtgate", "gate1"},
+		{"rtgate:", "rtgate", "rtgate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			plugName, instanceName := parsePlugEntry(tt.entry)
+			if plugName != tt.wantPlug || instanceName != tt.wantInstance {
+				t.Errorf("parsePlugEntry() = %s, %s, want %s, %s", plugName, instanceName, tt.wantPlug, tt.wantInstance)
+			}
+		})
+	}
+}
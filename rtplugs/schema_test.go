@@ -0,0 +1,90 @@
+package rtplugs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// schemaPlug declares its config keys and records the config it is initialized with
+type schemaPlug struct {
+	reconfigPlug
+	strict bool
+}
+
+func (p *schemaPlug) Init(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) context.Context {
+	p.c = c
+	return ctx
+}
+
+func (p *schemaPlug) ConfigSchema() pi.ConfigSchema {
+	return pi.ConfigSchema{Strict: p.strict, Keys: []pi.ConfigKey{
+		{Name: "rules", Required: true},
+		{Name: "retries", Type: pi.TypeInt, Default: "3"},
+		{Name: "period", Type: pi.TypeDuration},
+	}}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		c      map[string]string
+		want   string // the expected error, if any
+	}{
+		{"defaults", false, map[string]string{"rules": "all"}, ""},
+		{"reserved keys", true, map[string]string{"rules": "all", "mode": "monitor", "timeout": "1s"}, ""},
+		{"unknown key", false, map[string]string{"rules": "all", "retires": "5"}, ""},
+		{"strict unknown key", true, map[string]string{"rules": "all", "retires": "5"}, "unknown config keys retires"},
+		{"missing required", false, map[string]string{"retries": "5"}, `missing required config key "rules"`},
+		{"int", false, map[string]string{"rules": "all", "retries": "many"}, `"retries"`},
+		{"duration", false, map[string]string{"rules": "all", "period": "5"}, `"period"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &schemaPlug{reconfigPlug: reconfigPlug{fakePlug: fakePlug{name: "schema"}}, strict: tt.strict}
+			ap := newActivePlug(p, "schema", tt.c)
+			_, err := ap.init(context.Background(), tt.c, "svc", "ns", nil)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("init returned %v", err)
+				}
+				if p.c["retries"] == "" || p.c["rules"] != "all" {
+					t.Errorf("Init received config %v, expected defaults to be set", p.c)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !isFailure(err) {
+				t.Errorf("init returned %v, want a failure containing %q", err, tt.want)
+			}
+			if p.c != nil {
+				t.Errorf("Init was called with an invalid config")
+			}
+		})
+	}
+}
+
+func TestReconfigureSchema(t *testing.T) {
+	p := &schemaPlug{reconfigPlug: reconfigPlug{fakePlug: fakePlug{name: "schema"}}}
+	c := map[string]string{"rules": "all"}
+	ap := newActivePlug(p, "schema", c)
+	if _, err := ap.init(context.Background(), c, "svc", "ns", nil); err != nil {
+		t.Fatalf("init returned %v", err)
+	}
+
+	if err := ap.reconfigure(map[string]string{"rules": "all", "retries": "many", "mode": "monitor"}); err == nil {
+		t.Errorf("reconfigure with an illegal value returned nil")
+	}
+	if ap.policy().monitor || p.c["retries"] != "3" {
+		t.Errorf("a plug failing validation was reconfigured")
+	}
+
+	if err := ap.reconfigure(map[string]string{"rules": "some"}); err != nil {
+		t.Errorf("reconfigure returned %v", err)
+	}
+	if p.c["rules"] != "some" || p.c["retries"] != "3" {
+		t.Errorf("Reconfigure received config %v, expected defaults to be set", p.c)
+	}
+}
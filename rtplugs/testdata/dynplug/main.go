@@ -0,0 +1,33 @@
+// dynplug is built by the tests of LoadPlugs using `go build -buildmode=plugin`
+package main
+
+import (
+	"context"
+	"net/http"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+type plug struct{}
+
+func (p *plug) PlugName() string    { return "dynplug" }
+func (p *plug) PlugVersion() string { return "0.0.1" }
+
+func (p *plug) Init(ctx context.Context, c map[string]string, serviceName string, namespace string, logger pi.Logger) context.Context {
+	return ctx
+}
+
+func (p *plug) Shutdown() {}
+
+func (p *plug) ApproveRequest(req *http.Request) (*http.Request, error) {
+	req.Header.Set("X-Dynplug", "approved")
+	return req, nil
+}
+
+func (p *plug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	return resp, nil
+}
+
+func NewPlug() pi.RoundTripPlug {
+	return &plug{}
+}
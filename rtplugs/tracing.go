@@ -0,0 +1,98 @@
+package rtplugs
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+
+	pi "github.com/IBM/go-security-plugs/pluginterfaces"
+)
+
+// Trace context formats propagated in request headers
+var (
+	traceContextFormat = &tracecontext.HTTPFormat{}
+	b3Format           = &b3.HTTPFormat{}
+	traceFormats       = []propagation.HTTPFormat{traceContextFormat, b3Format}
+)
+
+// startRoundTripSpan() starts the span of a RoundTrip
+//
+// The span is a child of the span found in the request context (e.g. set by ochttp)
+// or else of the trace context propagated in the request headers (W3C traceparent or B3)
+func startRoundTripSpan(req *http.Request) (context.Context, *trace.Span) {
+	ctx := req.Context()
+	if trace.FromContext(ctx) == nil {
+		for _, format := range traceFormats {
+			if sc, ok := format.SpanContextFromRequest(req); ok {
+				return trace.StartSpanWithRemoteParent(ctx, "rtplugs.RoundTrip", sc)
+			}
+		}
+	}
+	return trace.StartSpan(ctx, "rtplugs.RoundTrip")
+}
+
+// startPlugSpan() starts the span of a single plug call, returning ctx carrying the span
+func startPlugSpan(ctx context.Context, ap *activePlug, phase string) (context.Context, *trace.Span) {
+	method := "ApproveRequest"
+	if phase == pi.PhaseResponse {
+		method = "ApproveResponse"
+	}
+	ctx, span := trace.StartSpan(ctx, "rtplugs."+ap.name()+"."+method)
+	span.AddAttributes(trace.StringAttribute("rtplugs.plug", ap.plug.PlugName()))
+	return ctx, span
+}
+
+// plugRequest() returns a shallow copy of req carrying the span of the plug call in ctx
+//
+// Spans started by the plug from the request context are children of the plug call span.
+// The span is replaced before the request reaches the next plug or the upstream (see withSpan).
+func plugRequest(ctx context.Context, req *http.Request) *http.Request {
+	return req.WithContext(trace.NewContext(req.Context(), trace.FromContext(ctx)))
+}
+
+// endPlugSpan() records the verdict of a plug call and ends its span
+func endPlugSpan(span *trace.Span, verdict string, reason error) {
+	span.AddAttributes(trace.StringAttribute("rtplugs.verdict", verdict))
+	switch verdict {
+	case pi.VerdictBlock:
+		code := int32(trace.StatusCodePermissionDenied)
+		if isFailure(reason) {
+			code = trace.StatusCodeInternal
+		}
+		span.SetStatus(trace.Status{Code: code, Message: reason.Error()})
+	case pi.VerdictSkip:
+		span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: reason.Error()})
+	}
+	span.End()
+}
+
+// withSpan() returns a shallow copy of req carrying the span of ctx
+//
+// The span is set in the request context and replaces the trace context of any
+// trace headers (W3C traceparent or B3) already propagated by the request.
+// The request context is otherwise kept, such that plugs may still cancel it.
+func withSpan(ctx context.Context, req *http.Request) *http.Request {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return req
+	}
+	out := req.WithContext(trace.NewContext(req.Context(), span))
+	sc := span.SpanContext()
+	var cloned bool
+	for _, format := range traceFormats {
+		if _, ok := format.SpanContextFromRequest(req); !ok {
+			continue
+		}
+		if !cloned {
+			// never modify the headers of the caller request
+			out.Header = req.Header.Clone()
+			cloned = true
+		}
+		format.SpanContextToRequest(sc, out)
+	}
+	return out
+}
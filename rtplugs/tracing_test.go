@@ -0,0 +1,146 @@
+package rtplugs
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+type collectExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *collectExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+type captureRoundTrip struct {
+	req *http.Request
+}
+
+func (rt *captureRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.req = req
+	return resptest, nil
+}
+
+func TestTracing(t *testing.T) {
+	exporter := new(collectExporter)
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		format propagation.HTTPFormat
+	}{
+		{"traceparent", "traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", &tracecontext.HTTPFormat{}},
+		{"b3", "X-B3-TraceId", "0af7651916cd43dd8448eb211c80319c", &b3.HTTPFormat{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.spans = nil
+			req, _ := http.NewRequest("GET", "http://10.0.0.1/", nil)
+			req.Header.Set(tt.header, tt.value)
+			if tt.header == "X-B3-TraceId" {
+				req.Header.Set("X-B3-SpanId", "b7ad6b7169203331")
+				req.Header.Set("X-B3-Sampled", "1")
+			}
+			incoming, _ := tt.format.SpanContextFromRequest(req)
+
+			next := new(captureRoundTrip)
+			rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: &fakePlug{name: "traced"}}}}}
+			rt.Transport(next)
+			if _, err := rt.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip returned err %v\n", err)
+			}
+
+			names := make(map[string]*trace.SpanData)
+			for _, s := range exporter.spans {
+				if s.TraceID != incoming.TraceID {
+					t.Errorf("span %s is not part of the incoming trace\n", s.Name)
+				}
+				names[s.Name] = s
+			}
+			for _, name := range []string{"rtplugs.RoundTrip", "rtplugs.approveRequests", "rtplugs.traced.ApproveRequest", "rtplugs.nextRoundTrip", "rtplugs.approveResponse", "rtplugs.traced.ApproveResponse"} {
+				if names[name] == nil {
+					t.Errorf("missing span %s\n", name)
+				}
+			}
+			if s := names["rtplugs.RoundTrip"]; s != nil && s.ParentSpanID != incoming.SpanID {
+				t.Errorf("rtplugs.RoundTrip is not a child of the incoming span\n")
+			}
+
+			// the upstream request continues the trace from the nextRoundTrip span
+			upstream, ok := tt.format.SpanContextFromRequest(next.req)
+			if s := names["rtplugs.nextRoundTrip"]; !ok || s == nil || upstream.SpanID != s.SpanID {
+				t.Errorf("upstream request does not propagate the nextRoundTrip span\n")
+			}
+			if !strings.EqualFold(req.Header.Get(tt.header), tt.value) {
+				t.Errorf("RoundTrip modified the caller request headers\n")
+			}
+		})
+	}
+}
+
+// spanPlug starts a span of its own while approving
+type spanPlug struct {
+	fakePlug
+}
+
+func (p *spanPlug) ApproveRequest(req *http.Request) (*http.Request, error) {
+	_, span := trace.StartSpan(req.Context(), "spanplug.request")
+	span.End()
+	return req, nil
+}
+
+func (p *spanPlug) ApproveResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	_, span := trace.StartSpan(req.Context(), "spanplug.response")
+	span.End()
+	return resp, nil
+}
+
+func TestPlugSpans(t *testing.T) {
+	exporter := new(collectExporter)
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	next := new(captureRoundTrip)
+	rt := &RoundTrip{chain: &chain{plugs: []*activePlug{{plug: &spanPlug{fakePlug{name: "spans"}}}}}}
+	rt.Transport(next)
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip returned err %v\n", err)
+	}
+
+	names := make(map[string]*trace.SpanData)
+	for _, s := range exporter.spans {
+		names[s.Name] = s
+	}
+	// spans started by the plug are children of the span of the plug call
+	for child, parent := range map[string]string{
+		"spanplug.request":  "rtplugs.spans.ApproveRequest",
+		"spanplug.response": "rtplugs.spans.ApproveResponse",
+	} {
+		if names[child] == nil || names[parent] == nil || names[child].ParentSpanID != names[parent].SpanID {
+			t.Errorf("span %s is not a child of %s\n", child, parent)
+		}
+	}
+	// the upstream request no longer carries the span of the plug call
+	if s := names["rtplugs.nextRoundTrip"]; s == nil || trace.FromContext(next.req.Context()).SpanContext().SpanID != s.SpanID {
+		t.Errorf("the upstream request does not carry the nextRoundTrip span\n")
+	}
+}